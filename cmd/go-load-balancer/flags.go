@@ -0,0 +1,50 @@
+package main
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"flag"
+	"fmt"
+	"os"
+)
+
+type flags struct {
+	configPath  string
+	checkConfig bool
+	// overrides holds the flags that have been set by the variable they override
+	overrides env.MapEnvironment
+}
+
+// overridingFlags maps flags to the variables they override
+var overridingFlags = map[string]string{
+	"zone":           "eb_go_lb_zone",
+	"mode":           "eb_go_lb_mode",
+	"handler-type":   "eb_go_lb_handler_type",
+	"listen-port":    "eb_go_lb_listen_port",
+	"node-name":      "eb_go_lb_node_name",
+	"gateways":       "eb_go_lb_gateways",
+	"weight-updater": "eb_go_lb_weight_updater",
+	"etcd-host":      "eb_go_lb_etcd_host",
+}
+
+// parseFlags reads the flags, the path of the configuration file defaults to eb_go_lb_config of the environment
+func parseFlags(args []string, environment env.Environment) (flags, error) {
+	f := flags{
+		overrides: make(env.MapEnvironment),
+	}
+	set := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	set.StringVar(&f.configPath, "config", environment.Get("eb_go_lb_config"), "path of the YAML configuration file (eb_go_lb_config)")
+	set.BoolVar(&f.checkConfig, "check-config", false, "validate the configuration and exit")
+	values := make(map[string]*string)
+	for name, variable := range overridingFlags {
+		values[name] = set.String(name, "", fmt.Sprintf("overrides %s", variable))
+	}
+	if err := set.Parse(args); err != nil {
+		return f, err
+	}
+	set.Visit(func(given *flag.Flag) {
+		if variable, found := overridingFlags[given.Name]; found {
+			f.overrides[variable] = *values[given.Name]
+		}
+	})
+	return f, nil
+}
@@ -1,70 +1,272 @@
 package main
 
 import (
+	"context"
+	"edgebench/go-load-balancer/pkg/config"
 	"edgebench/go-load-balancer/pkg/env"
 	"edgebench/go-load-balancer/pkg/handler"
 	"edgebench/go-load-balancer/pkg/server"
+	"edgebench/go-load-balancer/pkg/tracing"
 	"edgebench/go-load-balancer/pkg/util"
 	"fmt"
 	"go.uber.org/zap"
+	"io"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 func main() {
-	logger := util.InitZapLogger()
+	f, err := parseFlags(os.Args[1:], env.OsEnv)
+	if err != nil {
+		os.Exit(2)
+	}
+	cfg, err := loadConfig(f)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%s\n", indent(err.Error()))
+		os.Exit(1)
+	}
+	if f.checkConfig {
+		fmt.Println("configuration is valid")
+		return
+	}
+
+	logger := util.InitZapLoggerWithMode(cfg.Mode)
 	defer logger.Sync()
 
-	startReverseProxy()
+	lb, err := startReverseProxy(f, cfg)
+	if err != nil {
+		zap.S().Errorf("error starting go-load-balancer: %s", err)
+		logger.Sync()
+		os.Exit(1)
+	}
+
+	waitForSignal(lb)
+}
+
+func loadConfig(f flags) (config.Config, error) {
+	return config.Load(f.configPath, env.Layered(f.overrides, env.OsEnv))
+}
 
-	waitForSignal()
+func indent(text string) string {
+	return "  - " + strings.ReplaceAll(text, "\n", "\n  - ")
 }
 
-func waitForSignal() {
+func waitForSignal(lb *loadBalancer) {
 	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
-	<-sigs
-	zap.S().Info("received stop")
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range sigs {
+		if sig == syscall.SIGHUP {
+			zap.S().Info("received reload")
+			if err := lb.reload(); err != nil {
+				zap.S().Errorf("keep the current configuration, reload failed:\n%s", indent(err.Error()))
+			}
+			continue
+		}
+		zap.S().Info("received stop")
+		lb.shutdown(sigs)
+		return
+	}
 }
 
-func startReverseProxy() {
-	zone, ok := env.OsEnv.Lookup("eb_go_lb_zone")
-	if ok {
-		zap.S().Info("Start go-load-balancer in zone ", zone)
-	} else {
-		panic("No zone provided")
+// loadBalancer holds the parts of the running load balancer that are replaced when the configuration is reloaded
+type loadBalancer struct {
+	flags         flags
+	functionState *handler.FunctionState
+	stateManager  *handler.EtcdFunctionStateManager
+	weightUpdater handler.WeightUpdater
+	metrics       *handler.Metrics
+	overrides     *handler.Overrides
+	tracer        *tracing.Tracer
+	exporter      *tracing.OTLPExporter
+	server        *server.ReverseProxyServer
+	admin         *server.AdminServer
+	// mtx serializes weight updates and reloads, so that no update is lost while the handler is replaced
+	mtx    sync.Mutex
+	config config.Config
+}
+
+func startReverseProxy(f flags, cfg config.Config) (*loadBalancer, error) {
+	zap.S().Info("Start go-load-balancer in zone ", cfg.Zone)
+	zap.S().Info("instantiate '", cfg.Handler.Type, "' handler")
+
+	weightUpdater, err := handler.NewWeightUpdater(cfg.WeightUpdater)
+	if err != nil {
+		return nil, err
 	}
 
-	var handlerType handler.HandlerType
-	zap.S().Info("read HANDLER_TYPE")
-	if val, ok := env.OsEnv.Lookup("eb_go_lb_handler_type"); ok {
-		zap.S().Info("instantiate '", val, "' handler")
-		handlerType = handler.NewHandlerType(val)
-	} else {
-		zap.S().Info("no eb_go_lb_handler_type provided, default to 'dummy'")
-		handlerType = handler.Dummy
+	metrics := handler.NewMetrics(cfg.Zone)
+	if instrumented, ok := weightUpdater.(handler.Instrumented); ok {
+		instrumented.Instrument(metrics)
 	}
 
-	functionState := handler.NewFunctionState(zone)
-	handler.UpdateFunctionState(functionState)
-	handlerImpl := handler.NewHandler(handlerType, functionState)
-	go func() {
-		server.NewReverseProxyServer(handlerImpl).Run()
-	}()
+	functionState := handler.NewFunctionState(cfg.Zone)
+	if loader, ok := weightUpdater.(handler.FunctionStateLoader); ok {
+		if err := loader.LoadFunctionState(functionState); err != nil {
+			// updaters send all weights once their source is available
+			zap.S().Errorf("error loading function state: %s", err)
+		}
+	}
+	zap.S().Info("Loaded Functionstate: ", functionState)
+	tracer, exporter := tracing.NewTracerWithOptions(cfg.Tracing)
+	if tracer != nil {
+		zap.S().Infow("Export traces", "endpoint", cfg.Tracing.Endpoint, "sampleRatio", cfg.Tracing.SampleRatio)
+	}
+	lb := &loadBalancer{
+		flags:         f,
+		functionState: functionState,
+		stateManager:  handler.NewEtcdFunctionStateManager(functionState),
+		weightUpdater: weightUpdater,
+		metrics:       metrics,
+		overrides:     handler.NewOverrides(),
+		tracer:        tracer,
+		exporter:      exporter,
+		admin:         server.NewAdminServer(),
+		config:        cfg,
+	}
+	handlerImpl, err := lb.newHandler(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	lb.server = server.NewReverseProxyServer(handlerImpl)
+	if cfg.AdminPort != 0 {
+		lb.admin.Handle("/metrics", metrics.Handler())
+		lb.admin.Handle("/api/", handler.NewAdminAPI(functionState, lb.overrides, func() handler.Handler {
+			return lb.server.Handler()
+		}, cfg.AdminToken))
+		if err := lb.admin.Listen(fmt.Sprintf(":%d", cfg.AdminPort)); err != nil {
+			return nil, err
+		}
+	}
+	if err := lb.server.Listen(fmt.Sprintf(":%d", cfg.ListenPort)); err != nil {
+		return nil, err
+	}
 
 	go func() {
-		etcdClient, err := handler.NewEtcdClientFromEnv()
-		if err != nil {
-			panic(err)
-		}
-		weightUpdater := handler.NewEtcdWeightUpdater(etcdClient)
-		ch := weightUpdater.GetUpdates(fmt.Sprintf("golb/function/%s", zone))
+		ch := weightUpdater.GetUpdates(handler.FunctionKeyPrefix(cfg.Zone))
 		for ev := range ch {
 			zap.S().Debug(ev)
-			handlerImpl.HandleWeightUpdate(ev)
+			lb.handleWeightUpdate(ev)
 			zap.S().Debug("updated")
 		}
 
 	}()
+	return lb, nil
+}
+
+// handleWeightUpdate applies the update to the function state and to the handler. The state is updated whatever the
+// handler does with the update, e.g., the dummy handler ignores it, so a handler created on a reload starts with the
+// current weights.
+func (lb *loadBalancer) handleWeightUpdate(update *handler.WeightUpdate) {
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+	lb.stateManager.HandleWeightUpdate(update)
+	lb.server.Handler().HandleWeightUpdate(update)
+}
+
+// newHandler creates the handler of the configuration, it takes over the state of previous, which may be nil
+func (lb *loadBalancer) newHandler(cfg config.Config, previous handler.Handler) (handler.Handler, error) {
+	handlerImpl, err := handler.NewHandlerFromPrevious(lb.functionState, cfg.Handler, previous)
+	if err != nil {
+		return nil, err
+	}
+	if instrumented, ok := handlerImpl.(handler.Instrumented); ok {
+		instrumented.Instrument(lb.metrics)
+	}
+	if traced, ok := handlerImpl.(handler.Traced); ok && lb.tracer != nil {
+		traced.Trace(lb.tracer)
+	}
+	if overridable, ok := handlerImpl.(handler.Overridable); ok {
+		overridable.Override(lb.overrides)
+	}
+	return handlerImpl, nil
+}
+
+// reload reads the configuration again and replaces the handler and the listener. The zone, the mode, the admin port
+// and token, tracing and the weight updater cannot be changed at runtime.
+func (lb *loadBalancer) reload() error {
+	cfg, err := loadConfig(lb.flags)
+	if err != nil {
+		return err
+	}
+
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+	if cfg.Zone != lb.config.Zone || cfg.Mode != lb.config.Mode || cfg.AdminPort != lb.config.AdminPort ||
+		cfg.AdminToken != lb.config.AdminToken || cfg.Tracing != lb.config.Tracing ||
+		!reflect.DeepEqual(cfg.WeightUpdater, lb.config.WeightUpdater) {
+		zap.S().Warn("changes of the zone, the mode, the admin port and token, tracing and the weight updater require a restart and are ignored")
+		cfg.Zone, cfg.Mode, cfg.AdminPort, cfg.AdminToken = lb.config.Zone, lb.config.Mode, lb.config.AdminPort, lb.config.AdminToken
+		cfg.Tracing, cfg.WeightUpdater = lb.config.Tracing, lb.config.WeightUpdater
+	}
+
+	handlerImpl, err := lb.newHandler(cfg, lb.server.Handler())
+	if err != nil {
+		return err
+	}
+	if cfg.ListenPort != lb.config.ListenPort {
+		if err := lb.server.Listen(fmt.Sprintf(":%d", cfg.ListenPort)); err != nil {
+			if closer, ok := handlerImpl.(io.Closer); ok {
+				closer.Close()
+			}
+			return err
+		}
+	}
+	previous := lb.server.SetHandler(handlerImpl)
+	if closer, ok := previous.(io.Closer); ok {
+		closer.Close()
+	}
+	lb.config = cfg
+	zap.S().Infow("reloaded configuration", "handlerType", cfg.Handler.Type, "listenPort", cfg.ListenPort)
+	return nil
+}
+
+// shutdown fails the readiness check, waits the drain period so that no new requests are sent to the load balancer,
+// and then waits for the requests in flight before it closes the handler and the weight updater. Another signal on
+// sigs skips the rest of the drain period.
+func (lb *loadBalancer) shutdown(sigs <-chan os.Signal) {
+	lb.mtx.Lock()
+	drainPeriod, shutdownTimeout := lb.config.DrainPeriod, lb.config.ShutdownTimeout
+	lb.mtx.Unlock()
+
+	lb.server.SetReady(false)
+	zap.S().Infof("drain for %s", drainPeriod)
+	timer := time.NewTimer(drainPeriod)
+	select {
+	case <-timer.C:
+	case <-sigs:
+		timer.Stop()
+		zap.S().Info("received another stop, skip draining")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := lb.server.Shutdown(ctx); err != nil {
+		zap.S().Errorf("error waiting for requests in flight: %s", err)
+	}
+
+	if closer, ok := lb.weightUpdater.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			zap.S().Errorf("error closing weight updater: %s", err)
+		}
+	}
+	lb.mtx.Lock()
+	defer lb.mtx.Unlock()
+	if closer, ok := lb.server.Handler().(io.Closer); ok {
+		closer.Close()
+	}
+	if lb.exporter != nil {
+		lb.exporter.Close()
+	}
+	// the admin endpoints get their own timeout, the requests in flight may have used up the one of the server
+	adminCtx, cancelAdmin := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelAdmin()
+	if err := lb.admin.Shutdown(adminCtx); err != nil {
+		zap.S().Errorf("error shutting down admin endpoints: %s", err)
+	}
+	zap.S().Info("stopped")
 }
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"edgebench/go-load-balancer/pkg/handler"
+	"edgebench/go-load-balancer/pkg/server"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestLoadBalancer creates a load balancer with the configuration file at path that neither listens nor receives
+// weight updates
+func newTestLoadBalancer(t *testing.T, path string) *loadBalancer {
+	f := flags{configPath: path, overrides: env.MapEnvironment{"eb_go_lb_zone": "zone-a"}}
+	cfg, err := loadConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	functionState := handler.NewFunctionState(cfg.Zone)
+	lb := &loadBalancer{
+		flags:         f,
+		functionState: functionState,
+		stateManager:  handler.NewEtcdFunctionStateManager(functionState),
+		metrics:       handler.NewMetrics(cfg.Zone),
+		overrides:     handler.NewOverrides(),
+		admin:         server.NewAdminServer(),
+		config:        cfg,
+	}
+	handlerImpl, err := lb.newHandler(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lb.server = server.NewReverseProxyServer(handlerImpl)
+	t.Cleanup(func() {
+		if closer, ok := lb.server.Handler().(io.Closer); ok {
+			closer.Close()
+		}
+	})
+	return lb
+}
+
+func writeConfig(t *testing.T, path string, content string) {
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadFromDummyKeepsWeightUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "handler_type: dummy\n")
+	lb := newTestLoadBalancer(t, path)
+	lb.functionState.Put("removed", handler.Weights{Ips: []string{"10.2.0.1"}, Weights: []int{1}})
+	lb.functionState.Put("changed", handler.Weights{Ips: []string{"10.2.0.1"}, Weights: []int{1}})
+
+	// the updates arrive while the dummy handler is active
+	lb.handleWeightUpdate(handler.NewFunctionRemoval("removed"))
+	lb.handleWeightUpdate(handler.NewWeightUpdate("changed", handler.Weights{Ips: []string{"10.2.0.2"}, Weights: []int{1}}))
+	lb.handleWeightUpdate(handler.NewWeightUpdate("added", handler.Weights{Ips: []string{"10.2.0.3"}, Weights: []int{1}}))
+
+	writeConfig(t, path, "handler_type: wrr\n")
+	if err := lb.reload(); err != nil {
+		t.Fatal(err)
+	}
+	inspector, ok := lb.server.Handler().(handler.RouteInspector)
+	if !ok {
+		t.Fatalf("the handler has not been replaced, it is a %T", lb.server.Handler())
+	}
+	routes := inspector.Routes()
+	tests := []struct {
+		function string
+		ips      []string
+	}{
+		{"removed", nil},
+		{"changed", []string{"10.2.0.2"}},
+		{"added", []string{"10.2.0.3"}},
+	}
+	for _, test := range tests {
+		r, found := routes[test.function]
+		if test.ips == nil {
+			if found {
+				t.Errorf("%s is still routed after its removal", test.function)
+			}
+			continue
+		}
+		if !found || r.Route == nil || !reflect.DeepEqual(r.Route.Available.Ips, test.ips) {
+			t.Errorf("%s is routed as %+v, expected %v", test.function, r.Route, test.ips)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	environment := env.MapEnvironment{"eb_go_lb_config": "environment.yaml"}
+	f, err := parseFlags([]string{"-zone", "zone-b"}, environment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.configPath != "environment.yaml" {
+		t.Errorf("got config path %s, expected the one of the environment", f.configPath)
+	}
+	if !reflect.DeepEqual(f.overrides, env.MapEnvironment{"eb_go_lb_zone": "zone-b"}) {
+		t.Errorf("got overrides %v, expected only the zone", f.overrides)
+	}
+
+	f, err = parseFlags([]string{"-config", "flag.yaml"}, environment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.configPath != "flag.yaml" {
+		t.Errorf("got config path %s, expected the flag to override the environment", f.configPath)
+	}
+}
+
+// blockingHandler answers requests once release is closed
+type blockingHandler struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+}
+
+func (h *blockingHandler) Handle(res http.ResponseWriter, _ *http.Request) {
+	h.once.Do(func() {
+		close(h.started)
+	})
+	<-h.release
+	res.WriteHeader(http.StatusOK)
+}
+
+func (h *blockingHandler) HandleWeightUpdate(*handler.WeightUpdate) {}
+
+func freeAddr(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	writeConfig(t, path, "handler_type: dummy\ndrain_period: 200ms\nshutdown_timeout: 5s\n")
+	lb := newTestLoadBalancer(t, path)
+	addr := freeAddr(t)
+	if err := lb.server.Listen(addr); err != nil {
+		t.Fatal(err)
+	}
+	blocking := &blockingHandler{started: make(chan struct{}), release: make(chan struct{})}
+	lb.server.SetHandler(blocking)
+
+	inFlight := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + addr + "/function/f/")
+		if err != nil {
+			t.Error(err)
+			inFlight <- 0
+			return
+		}
+		resp.Body.Close()
+		inFlight <- resp.StatusCode
+	}()
+	<-blocking.started
+
+	stopped := make(chan struct{})
+	go func() {
+		lb.shutdown(make(chan os.Signal))
+		close(stopped)
+	}()
+
+	// the listener stays open during the drain period, but the readiness check fails
+	deadline := time.Now().Add(time.Second)
+	for {
+		resp, err := http.Get("http://" + addr + server.ReadinessPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("readiness answers %d while draining, expected 503", resp.StatusCode)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// shutdown waits for the request in flight after the drain period
+	select {
+	case <-stopped:
+		t.Fatal("shutdown returned while a request was in flight")
+	case <-time.After(400 * time.Millisecond):
+	}
+	close(blocking.release)
+	if status := <-inFlight; status != http.StatusOK {
+		t.Errorf("the request in flight got status %d, expected 200", status)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("shutdown did not return after the request finished")
+	}
+	if _, err := http.Get("http://" + addr + server.ReadinessPath); err == nil {
+		t.Error("the listener is still open after the shutdown")
+	}
+}
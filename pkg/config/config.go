@@ -0,0 +1,159 @@
+package config
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"edgebench/go-load-balancer/pkg/handler"
+	"edgebench/go-load-balancer/pkg/tracing"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"strings"
+	"time"
+)
+
+// Config is the complete configuration of the load balancer. It is read from a YAML file and the eb_go_lb_* variables
+// of the environment override the values of the file.
+type Config struct {
+	Zone       string `yaml:"zone"`
+	Mode       string `yaml:"mode"`
+	ListenPort int    `yaml:"listen_port"`
+	// AdminPort serves the metrics, 0 disables it
+	AdminPort int `yaml:"admin_port"`
+	// AdminToken enables changing the overrides of the admin API with this bearer token, empty disables it
+	AdminToken string `yaml:"admin_token"`
+	// DrainPeriod is the time between failing the readiness check and closing the listener on shutdown
+	DrainPeriod time.Duration `yaml:"drain_period"`
+	// ShutdownTimeout bounds the time requests in flight have to finish after the listener is closed
+	ShutdownTimeout time.Duration                `yaml:"shutdown_timeout"`
+	WeightUpdater   handler.WeightUpdaterOptions `yaml:"weight_updater"`
+	Tracing         tracing.Options              `yaml:"tracing"`
+	Handler         handler.Options              `yaml:",inline"`
+}
+
+func NewDefaultConfig() Config {
+	return Config{
+		Mode:            "dev",
+		ListenPort:      8079,
+		AdminPort:       8077,
+		DrainPeriod:     5 * time.Second,
+		ShutdownTimeout: 30 * time.Second,
+		WeightUpdater:   handler.NewDefaultWeightUpdaterOptions(),
+		Tracing:         tracing.NewDefaultOptions(),
+		Handler:         handler.NewDefaultOptions(),
+	}
+}
+
+// Load reads the configuration from the file at path, if path is not empty, overrides it with the environment and
+// validates the result. The returned error lists all problems that have been found.
+func Load(path string, environment env.Environment) (Config, error) {
+	config := NewDefaultConfig()
+	if path != "" {
+		if err := config.readFile(path); err != nil {
+			return config, err
+		}
+	}
+	if err := config.readEnvironment(environment); err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+func (config *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+func (config *Config) readEnvironment(environment env.Environment) error {
+	var err error
+	if zone, found := environment.Lookup("eb_go_lb_zone"); found {
+		config.Zone = zone
+	}
+	if mode, found := environment.Lookup("eb_go_lb_mode"); found {
+		config.Mode = mode
+	}
+	if port, found, err := environment.LookupInt("eb_go_lb_listen_port"); found {
+		if err != nil {
+			return fmt.Errorf("eb_go_lb_listen_port: %s", err)
+		}
+		config.ListenPort = int(port)
+	}
+	if port, found, err := environment.LookupInt("eb_go_lb_admin_port"); found {
+		if err != nil {
+			return fmt.Errorf("eb_go_lb_admin_port: %s", err)
+		}
+		config.AdminPort = int(port)
+	}
+	if token, found := environment.Lookup("eb_go_lb_admin_token"); found {
+		config.AdminToken = token
+	}
+	if drainPeriod, found, err := environment.LookupDuration("eb_go_lb_drain_period"); found {
+		if err != nil {
+			return fmt.Errorf("eb_go_lb_drain_period: %s", err)
+		}
+		config.DrainPeriod = drainPeriod
+	}
+	if timeout, found, err := environment.LookupDuration("eb_go_lb_shutdown_timeout"); found {
+		if err != nil {
+			return fmt.Errorf("eb_go_lb_shutdown_timeout: %s", err)
+		}
+		config.ShutdownTimeout = timeout
+	}
+	if config.WeightUpdater, err = handler.ReadWeightUpdaterOptions(environment, config.WeightUpdater); err != nil {
+		return err
+	}
+	if config.Tracing, err = tracing.ReadOptions(environment, config.Tracing); err != nil {
+		return err
+	}
+	if config.Handler, err = handler.ReadOptions(environment, config.Handler); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Validate returns all problems of the configuration
+func (config Config) Validate() error {
+	var errs []error
+	if config.Zone == "" {
+		errs = append(errs, errors.New("zone: is required"))
+	} else if strings.ContainsAny(config.Zone, "/,@") {
+		errs = append(errs, fmt.Errorf("zone: '%s' must not contain '/', ',' or '@'", config.Zone))
+	}
+	if config.Mode != "dev" && config.Mode != "prod" {
+		errs = append(errs, fmt.Errorf("mode: expected dev or prod, got '%s'", config.Mode))
+	}
+	if config.ListenPort < 1 || config.ListenPort > 65535 {
+		errs = append(errs, fmt.Errorf("listen_port: invalid port %d", config.ListenPort))
+	}
+	if config.AdminPort < 0 || config.AdminPort > 65535 {
+		errs = append(errs, fmt.Errorf("admin_port: invalid port %d", config.AdminPort))
+	} else if config.AdminPort == config.ListenPort {
+		errs = append(errs, fmt.Errorf("admin_port: %d is already used by the load balancer", config.AdminPort))
+	}
+	if config.DrainPeriod < 0 {
+		errs = append(errs, fmt.Errorf("drain_period: must not be negative, got %s", config.DrainPeriod))
+	}
+	if config.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("shutdown_timeout: must be positive, got %s", config.ShutdownTimeout))
+	}
+	if err := config.WeightUpdater.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("weight_updater: %s", err))
+	} else if config.WeightUpdater.Type == "http" && config.WeightUpdater.ListenPort == config.ListenPort {
+		errs = append(errs, fmt.Errorf("weight_updater: listen_port %d is already used by the load balancer", config.ListenPort))
+	} else if config.WeightUpdater.Type == "http" && config.WeightUpdater.ListenPort == config.AdminPort {
+		errs = append(errs, fmt.Errorf("weight_updater: listen_port %d is already used by the admin endpoints", config.AdminPort))
+	}
+	if err := config.Tracing.Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("tracing: %s", err))
+	}
+	if err := config.Handler.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `
+zone: zone-a
+listen_port: 9000
+drain_period: 1s
+handler_type: hash
+weight_updater:
+  type: file
+  file: weights.yaml
+`)
+	cfg, err := Load(path, env.MapEnvironment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Zone != "zone-a" || cfg.ListenPort != 9000 || cfg.DrainPeriod != time.Second {
+		t.Errorf("got zone %s, port %d and drain period %s from the file", cfg.Zone, cfg.ListenPort, cfg.DrainPeriod)
+	}
+	if cfg.Handler.Type != "hash" || cfg.WeightUpdater.Type != "file" || cfg.WeightUpdater.File != "weights.yaml" {
+		t.Errorf("got handler %s and updater %+v from the file", cfg.Handler.Type, cfg.WeightUpdater)
+	}
+	// keys that are missing in the file keep their defaults
+	if defaults := NewDefaultConfig(); cfg.AdminPort != defaults.AdminPort || cfg.Mode != defaults.Mode {
+		t.Errorf("got admin port %d and mode %s, expected the defaults", cfg.AdminPort, cfg.Mode)
+	}
+}
+
+func TestLoadWithoutFile(t *testing.T) {
+	cfg, err := Load("", env.MapEnvironment{"eb_go_lb_zone": "zone-a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Zone != "zone-a" || cfg.ListenPort != 8079 {
+		t.Errorf("got zone %s and port %d", cfg.Zone, cfg.ListenPort)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		file        string
+		environment env.MapEnvironment
+		expect      string
+	}{
+		{"unknown key", "zone: zone-a\nlisten: 80\n", nil, "field listen not found"},
+		{"invalid yaml", "zone: [", nil, "config.yaml"},
+		{"invalid variable", "zone: zone-a\n", env.MapEnvironment{"eb_go_lb_listen_port": "http"}, "eb_go_lb_listen_port"},
+		{"invalid result", "zone: zone-a\nmode: test\n", nil, "mode: expected dev or prod"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			environment := test.environment
+			if environment == nil {
+				environment = env.MapEnvironment{}
+			}
+			_, err := Load(writeConfig(t, test.file), environment)
+			if err == nil || !strings.Contains(err.Error(), test.expect) {
+				t.Errorf("got error %v, expected it to contain '%s'", err, test.expect)
+			}
+		})
+	}
+	if _, err := Load(filepath.Join(t.TempDir(), "missing.yaml"), env.MapEnvironment{}); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeConfig(t, "zone: file\nmode: prod\nlisten_port: 9000\nhandler_type: hash\n")
+	environment := env.MapEnvironment{"eb_go_lb_zone": "environment", "eb_go_lb_listen_port": "9001"}
+	// main layers the flags over the environment
+	flags := env.MapEnvironment{"eb_go_lb_zone": "flag"}
+
+	cfg, err := Load(path, env.Layered(flags, environment))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Zone != "flag" {
+		t.Errorf("got zone %s, expected the flag to override the environment and the file", cfg.Zone)
+	}
+	if cfg.ListenPort != 9001 {
+		t.Errorf("got port %d, expected the environment to override the file", cfg.ListenPort)
+	}
+	if cfg.Mode != "prod" || cfg.Handler.Type != "hash" {
+		t.Errorf("got mode %s and handler %s, expected the values of the file", cfg.Mode, cfg.Handler.Type)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		expect []string
+	}{
+		{"valid", func(cfg *Config) {}, nil},
+		{"missing zone", func(cfg *Config) { cfg.Zone = "" }, []string{"zone: is required"}},
+		{"zone with separator", func(cfg *Config) { cfg.Zone = "zone/a" }, []string{"zone: 'zone/a'"}},
+		{"mode", func(cfg *Config) { cfg.Mode = "test" }, []string{"mode:"}},
+		{"listen port", func(cfg *Config) { cfg.ListenPort = 0 }, []string{"listen_port: invalid port 0"}},
+		{"admin port", func(cfg *Config) { cfg.AdminPort = 70000 }, []string{"admin_port: invalid port"}},
+		{"disabled admin port", func(cfg *Config) { cfg.AdminPort = 0 }, nil},
+		{"admin port in use", func(cfg *Config) { cfg.AdminPort = cfg.ListenPort }, []string{"admin_port: 8079 is already used"}},
+		{"drain period", func(cfg *Config) { cfg.DrainPeriod = -time.Second }, []string{"drain_period:"}},
+		{"shutdown timeout", func(cfg *Config) { cfg.ShutdownTimeout = 0 }, []string{"shutdown_timeout:"}},
+		{"weight updater", func(cfg *Config) { cfg.WeightUpdater.Type = "consul" }, []string{"weight_updater: unknown weight updater"}},
+		{"weight updater port in use", func(cfg *Config) {
+			cfg.WeightUpdater.Type = "http"
+			cfg.WeightUpdater.ListenPort = cfg.ListenPort
+		}, []string{"weight_updater: listen_port 8079"}},
+		{"all problems", func(cfg *Config) {
+			cfg.Zone = ""
+			cfg.Mode = "test"
+			cfg.ListenPort = -1
+		}, []string{"zone:", "mode:", "listen_port:"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := NewDefaultConfig()
+			cfg.Zone = "zone-a"
+			test.change(&cfg)
+			err := cfg.Validate()
+			if len(test.expect) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors %v", test.expect)
+			}
+			for _, expect := range test.expect {
+				if !strings.Contains(err.Error(), expect) {
+					t.Errorf("error '%s' does not contain '%s'", err, expect)
+				}
+			}
+		})
+	}
+}
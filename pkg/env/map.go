@@ -0,0 +1,90 @@
+package env
+
+import "time"
+
+// MapEnvironment is an Environment backed by a map, e.g., to provide values that have been read from flags or files
+type MapEnvironment map[string]string
+
+func (env MapEnvironment) Set(key string, value string) {
+	env[key] = value
+}
+
+func (env MapEnvironment) Lookup(key string) (string, bool) {
+	value, found := env[key]
+	return value, found
+}
+
+func (env MapEnvironment) Get(key string) string {
+	return env[key]
+}
+
+func (env MapEnvironment) LookupInt(key string) (int64, bool, error) {
+	return LookupInt(env, key)
+}
+
+func (env MapEnvironment) LookupFloat(key string) (float64, bool, error) {
+	return LookupFloat(env, key)
+}
+
+func (env MapEnvironment) LookupFields(key string) ([]string, bool, error) {
+	return LookupFields(env, key)
+}
+
+func (env MapEnvironment) LookupBool(key string) (bool, bool, error) {
+	return LookupBool(env, key)
+}
+
+func (env MapEnvironment) LookupDuration(key string) (time.Duration, bool, error) {
+	return LookupDuration(env, key)
+}
+
+// layeredEnvironment looks up keys in its layers in order and returns the first value that is found
+type layeredEnvironment struct {
+	layers []Environment
+}
+
+// Layered returns an Environment in which the values of earlier layers override the ones of later layers. Set writes
+// to the first layer.
+func Layered(layers ...Environment) Environment {
+	return &layeredEnvironment{
+		layers: layers,
+	}
+}
+
+func (env *layeredEnvironment) Set(key string, value string) {
+	env.layers[0].Set(key, value)
+}
+
+func (env *layeredEnvironment) Lookup(key string) (string, bool) {
+	for _, layer := range env.layers {
+		if value, found := layer.Lookup(key); found {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func (env *layeredEnvironment) Get(key string) string {
+	value, _ := env.Lookup(key)
+	return value
+}
+
+func (env *layeredEnvironment) LookupInt(key string) (int64, bool, error) {
+	return LookupInt(env, key)
+}
+
+func (env *layeredEnvironment) LookupFloat(key string) (float64, bool, error) {
+	return LookupFloat(env, key)
+}
+
+func (env *layeredEnvironment) LookupFields(key string) ([]string, bool, error) {
+	return LookupFields(env, key)
+}
+
+func (env *layeredEnvironment) LookupBool(key string) (bool, bool, error) {
+	return LookupBool(env, key)
+}
+
+func (env *layeredEnvironment) LookupDuration(key string) (time.Duration, bool, error) {
+	return LookupDuration(env, key)
+}
@@ -0,0 +1,248 @@
+package handler
+
+import (
+	"crypto/subtle"
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RouteInfo describes the strategy of a function and the backends it selects from
+type RouteInfo struct {
+	Strategy  string      `json:"strategy"`
+	Available Weights     `json:"available"`
+	Fallback  Weights     `json:"fallback"`
+	State     interface{} `json:"state,omitempty"`
+}
+
+// FunctionRoutes shows how a function is routed. Weights are the weights of the WeightUpdater, Effective the weights
+// after applying the overrides. The route is used for requests from clients, the route without gateway for requests
+// that have been forwarded by another load balancer. Routes are missing if no backend is available.
+type FunctionRoutes struct {
+	Weights             Weights    `json:"weights"`
+	Effective           Weights    `json:"effective"`
+	Route               *RouteInfo `json:"route"`
+	RouteWithoutGateway *RouteInfo `json:"route_without_gateway"`
+}
+
+// RouteInspector is implemented by handlers that expose their routes
+type RouteInspector interface {
+	Routes() map[string]FunctionRoutes
+}
+
+func newRouteInfo(r route, found bool) *RouteInfo {
+	if !found {
+		return nil
+	}
+	info := &RouteInfo{
+		Strategy:  fmt.Sprintf("%T", r.strategy),
+		Available: r.available,
+		Fallback:  r.fallback,
+	}
+	if inspector, ok := r.strategy.(loadbalancer.Inspector); ok {
+		info.State = inspector.Inspect()
+	}
+	return info
+}
+
+func (handler *WeightedRoundRobinHandler) Routes() map[string]FunctionRoutes {
+	handler.updateMtx.Lock()
+	overrides := handler.overrides
+	handler.updateMtx.Unlock()
+
+	table := handler.table.Load()
+	routes := make(map[string]FunctionRoutes, len(table.functions))
+	for function, weights := range table.functions {
+		r, found := table.routes[function]
+		withoutGateway, foundWithoutGateway := table.routesWithoutGateway[function]
+		routes[function] = FunctionRoutes{
+			Weights:             weights,
+			Effective:           overrides.Apply(function, weights),
+			Route:               newRouteInfo(r, found),
+			RouteWithoutGateway: newRouteInfo(withoutGateway, foundWithoutGateway),
+		}
+	}
+	return routes
+}
+
+// AdminAPI serves JSON views of the routing state and manages the overrides:
+//
+//	GET    /api/functions        weights of all functions
+//	GET    /api/routes           routes and strategy state of all functions
+//	GET    /api/overrides        active overrides
+//	POST   /api/overrides        add an override, e.g. {"type": "drain", "ip": "10.0.0.1:8080", "ttl": "10m"}
+//	DELETE /api/overrides/<id>   remove an override
+//
+// Overrides can only be changed if the API has a token, which the requests have to send as bearer token.
+type AdminAPI struct {
+	functionState *FunctionState
+	overrides     *Overrides
+	handler       func() Handler
+	token         string
+	mux           *http.ServeMux
+}
+
+// overrideRequest is an Override that expires after TTL
+type overrideRequest struct {
+	Override
+	TTL Duration `json:"ttl"`
+}
+
+// NewAdminAPI creates the API, handler returns the handler that currently serves requests. An empty token disables
+// changing the overrides.
+func NewAdminAPI(functionState *FunctionState, overrides *Overrides, handler func() Handler, token string) *AdminAPI {
+	api := &AdminAPI{
+		functionState: functionState,
+		overrides:     overrides,
+		handler:       handler,
+		token:         token,
+		mux:           http.NewServeMux(),
+	}
+	api.mux.HandleFunc("/api/functions", api.serveFunctions)
+	api.mux.HandleFunc("/api/routes", api.serveRoutes)
+	api.mux.HandleFunc("/api/overrides", api.serveOverrides)
+	api.mux.HandleFunc("/api/overrides/", api.serveOverride)
+	return api
+}
+
+func (api *AdminAPI) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	api.mux.ServeHTTP(res, req)
+}
+
+func writeJSON(res http.ResponseWriter, status int, value interface{}) {
+	res.Header().Set("Content-Type", "application/json")
+	res.WriteHeader(status)
+	encoder := json.NewEncoder(res)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func allowMethods(res http.ResponseWriter, req *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if req.Method == method {
+			return true
+		}
+	}
+	res.Header().Set("Allow", strings.Join(methods, ", "))
+	http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// authorize returns whether the request may change the overrides, otherwise it responds with an error
+func (api *AdminAPI) authorize(res http.ResponseWriter, req *http.Request) bool {
+	if api.token == "" {
+		http.Error(res, "changing overrides is disabled, set eb_go_lb_admin_token to enable it", http.StatusForbidden)
+		return false
+	}
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !found || subtle.ConstantTimeCompare([]byte(token), []byte(api.token)) != 1 {
+		res.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(res, "invalid or missing bearer token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// checkBackends returns an error if the override sends requests to a host that is not a backend of the function
+func (api *AdminAPI) checkBackends(override Override) error {
+	var ips []string
+	switch override.Type {
+	case Pin:
+		ips = []string{override.Ip}
+	case SetWeights:
+		ips = override.Weights.Ips
+	default:
+		return nil
+	}
+	weights, found := api.functionState.Function(override.Function)
+	if !found {
+		return fmt.Errorf("unknown function %s", override.Function)
+	}
+	backends := make(map[string]bool, len(weights.Ips))
+	for _, ip := range weights.Ips {
+		backends[ip] = true
+	}
+	for _, ip := range ips {
+		if !backends[ip] {
+			return fmt.Errorf("%s is not a backend of function %s", ip, override.Function)
+		}
+	}
+	return nil
+}
+
+func (api *AdminAPI) serveFunctions(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet) {
+		return
+	}
+	writeJSON(res, http.StatusOK, struct {
+		Zone      string             `json:"zone"`
+		Functions map[string]Weights `json:"functions"`
+	}{api.functionState.Zone, api.functionState.Functions()})
+}
+
+func (api *AdminAPI) serveRoutes(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet) {
+		return
+	}
+	inspector, ok := api.handler().(RouteInspector)
+	if !ok {
+		http.Error(res, "the handler has no routes", http.StatusNotFound)
+		return
+	}
+	writeJSON(res, http.StatusOK, inspector.Routes())
+}
+
+func (api *AdminAPI) serveOverrides(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if req.Method == http.MethodGet {
+		writeJSON(res, http.StatusOK, api.overrides.List())
+		return
+	}
+	if !api.authorize(res, req) {
+		return
+	}
+
+	var request overrideRequest
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&request); err != nil {
+		http.Error(res, fmt.Sprintf("error parsing override: %s", err), http.StatusBadRequest)
+		return
+	}
+	if request.TTL <= 0 {
+		http.Error(res, "override requires a positive ttl, e.g. \"10m\"", http.StatusBadRequest)
+		return
+	}
+	if err := request.Override.Validate(); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := api.checkBackends(request.Override); err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	request.Override.Expires = time.Now().Add(time.Duration(request.TTL))
+	override, err := api.overrides.Add(request.Override)
+	if err != nil {
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(res, http.StatusCreated, override)
+}
+
+func (api *AdminAPI) serveOverride(res http.ResponseWriter, req *http.Request) {
+	if !allowMethods(res, req, http.MethodDelete) || !api.authorize(res, req) {
+		return
+	}
+	id := strings.TrimPrefix(req.URL.Path, "/api/overrides/")
+	if !api.overrides.Remove(id) {
+		http.Error(res, fmt.Sprintf("override %s not found", id), http.StatusNotFound)
+		return
+	}
+	res.WriteHeader(http.StatusNoContent)
+}
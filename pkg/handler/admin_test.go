@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAdminAPI(t *testing.T) {
+	functionState := NewFunctionState("zone-a")
+	functionState.Put("f", Weights{Ips: []string{"10.2.0.1:8080", "10.2.0.2:8080"}, Weights: []int{1, 1}})
+	overrides := NewOverrides()
+	handler := newTestHandler(newStickyFactory(&inFlightCounts{counts: make(map[string]int)}), FunctionPolicy{}, nil)
+	api := NewAdminAPI(functionState, overrides, func() Handler { return handler }, "secret")
+	disabled := NewAdminAPI(functionState, overrides, func() Handler { return handler }, "")
+
+	tests := []struct {
+		name   string
+		api    *AdminAPI
+		method string
+		path   string
+		token  string
+		body   string
+		status int
+	}{
+		{"functions", api, http.MethodGet, "/api/functions", "", "", http.StatusOK},
+		{"routes", api, http.MethodGet, "/api/routes", "", "", http.StatusOK},
+		{"list overrides", api, http.MethodGet, "/api/overrides", "", "", http.StatusOK},
+		{"functions are read only", api, http.MethodPost, "/api/functions", "secret", "{}", http.StatusMethodNotAllowed},
+		{"pin", api, http.MethodPost, "/api/overrides", "secret", `{"type": "pin", "function": "f", "ip": "10.2.0.1:8080", "ttl": "1m"}`, http.StatusCreated},
+		{"disabled", disabled, http.MethodPost, "/api/overrides", "secret", `{"type": "pin", "function": "f", "ip": "10.2.0.1:8080", "ttl": "1m"}`, http.StatusForbidden},
+		{"without token", api, http.MethodPost, "/api/overrides", "", `{"type": "pin", "function": "f", "ip": "10.2.0.1:8080", "ttl": "1m"}`, http.StatusUnauthorized},
+		{"wrong token", api, http.MethodPost, "/api/overrides", "guess", `{"type": "pin", "function": "f", "ip": "10.2.0.1:8080", "ttl": "1m"}`, http.StatusUnauthorized},
+		{"pin to another host", api, http.MethodPost, "/api/overrides", "secret", `{"type": "pin", "function": "f", "ip": "203.0.113.1:80", "ttl": "1m"}`, http.StatusBadRequest},
+		{"weights of another host", api, http.MethodPost, "/api/overrides", "secret", `{"type": "weights", "function": "f", "weights": {"ips": ["203.0.113.1:80"], "weights": [1]}, "ttl": "1m"}`, http.StatusBadRequest},
+		{"pin of an unknown function", api, http.MethodPost, "/api/overrides", "secret", `{"type": "pin", "function": "g", "ip": "10.2.0.1:8080", "ttl": "1m"}`, http.StatusBadRequest},
+		{"drain", api, http.MethodPost, "/api/overrides", "secret", `{"type": "drain", "ip": "10.2.0.2:8080", "ttl": "1m"}`, http.StatusCreated},
+		{"without ttl", api, http.MethodPost, "/api/overrides", "secret", `{"type": "drain", "ip": "10.2.0.2:8080"}`, http.StatusBadRequest},
+		{"unknown field", api, http.MethodPost, "/api/overrides", "secret", `{"type": "drain", "ip": "10.2.0.2:8080", "ttl": "1m", "x": 1}`, http.StatusBadRequest},
+		{"delete without token", api, http.MethodDelete, "/api/overrides/1", "", "", http.StatusUnauthorized},
+		{"delete", api, http.MethodDelete, "/api/overrides/1", "secret", "", http.StatusNoContent},
+		{"delete unknown", api, http.MethodDelete, "/api/overrides/1", "secret", "", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if test.token != "" {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			res := httptest.NewRecorder()
+			test.api.ServeHTTP(res, req)
+			if res.Code != test.status {
+				t.Errorf("got status %d, expected %d: %s", res.Code, test.status, res.Body)
+			}
+		})
+	}
+
+	// only the drain is left
+	res := httptest.NewRecorder()
+	api.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/overrides", nil))
+	var list []Override
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Type != Drain {
+		t.Errorf("overrides are %+v, expected the drain", list)
+	}
+}
@@ -1,9 +1,8 @@
 package handler
 
 import (
-	"fmt"
+	"edgebench/go-load-balancer/pkg/loadbalancer"
 	"net/http"
-	"strings"
 )
 
 type Handler interface {
@@ -11,32 +10,39 @@ type Handler interface {
 	HandleWeightUpdate(update *WeightUpdate)
 }
 
-type HandlerType int
+// HandlerType is either Dummy or the name of a strategy registered in the loadbalancer package
+type HandlerType string
 
 const (
-	Dummy HandlerType = iota
-	WeightedRR
+	Dummy      HandlerType = "dummy"
+	WeightedRR HandlerType = "wrr"
 )
 
-func NewHandlerType(handlerType string) HandlerType {
-	switch strings.ToLower(handlerType) {
-	case "dummy":
-		return Dummy
-	case "wrr":
-		return WeightedRR
+// UpdateType tells whether a WeightUpdate sets the weights of a function or removes the function
+type UpdateType int
+
+const (
+	Put UpdateType = iota
+	Delete
+)
+
+func (updateType UpdateType) String() string {
+	switch updateType {
+	case Put:
+		return "put"
+	case Delete:
+		return "delete"
 	default:
-		err := fmt.Sprintf("Error unknown handlertype: %s", handlerType)
-		panic(err)
+		return "unknown"
 	}
 }
 
 type WeightUpdate struct {
+	Type     UpdateType
 	Zone     string
 	Function string
-	Weights  Weights
+	// Weights is empty for Delete updates
+	Weights Weights
 }
 
-type Weights struct {
-	Ips     []string `json:"ips"`
-	Weights []int    `json:"weights"`
-}
+type Weights = loadbalancer.Weights
@@ -0,0 +1,350 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// BackendAdmitter decides right before a request is sent to a backend whether the backend accepts it. Admitting a
+// request may reserve capacity, which is released once the result of the request is observed.
+type BackendAdmitter interface {
+	Admit(function string, ip string) bool
+}
+
+type CircuitBreakerOptions struct {
+	Enabled bool `yaml:"enabled"`
+	// Window is the rolling window the error rate and slow call rate are calculated over
+	Window time.Duration `yaml:"window"`
+	// MinRequests is the number of requests in the window that is needed before the breaker can trip
+	MinRequests int `yaml:"min_requests"`
+	// ErrorRate trips the breaker once this share of requests in the window failed with a 5xx or transport error
+	ErrorRate float64 `yaml:"error_rate"`
+	// SlowCallDuration is the latency above which a request counts as slow, 0 disables the latency criterion
+	SlowCallDuration time.Duration `yaml:"slow_call_duration"`
+	// SlowCallRate trips the breaker once this share of requests in the window was slow
+	SlowCallRate float64 `yaml:"slow_call_rate"`
+	// OpenDuration is the time an open breaker waits until it lets probe requests through
+	OpenDuration time.Duration `yaml:"open_duration"`
+	// HalfOpenProbes is the number of requests that are let through while half-open, all of them have to succeed to
+	// close the breaker
+	HalfOpenProbes int `yaml:"half_open_probes"`
+}
+
+func NewDefaultCircuitBreakerOptions() CircuitBreakerOptions {
+	return CircuitBreakerOptions{
+		Enabled:          false,
+		Window:           10 * time.Second,
+		MinRequests:      20,
+		ErrorRate:        0.5,
+		SlowCallDuration: 0,
+		SlowCallRate:     0.5,
+		OpenDuration:     30 * time.Second,
+		HalfOpenProbes:   3,
+	}
+}
+
+// ReadCircuitBreakerOptions overrides the options with the eb_go_lb_circuit_breaker* variables of the environment
+func ReadCircuitBreakerOptions(environment env.Environment, options CircuitBreakerOptions) (CircuitBreakerOptions, error) {
+	if enabled, found, err := environment.LookupBool("eb_go_lb_circuit_breaker"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_circuit_breaker: %s", err)
+		}
+		options.Enabled = enabled
+	}
+	if window, found, err := environment.LookupDuration("eb_go_lb_circuit_breaker_window"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_circuit_breaker_window: %s", err)
+		}
+		options.Window = window
+	}
+	if minRequests, found, err := environment.LookupInt("eb_go_lb_circuit_breaker_min_requests"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_circuit_breaker_min_requests: %s", err)
+		}
+		options.MinRequests = int(minRequests)
+	}
+	if rate, found, err := environment.LookupFloat("eb_go_lb_circuit_breaker_error_rate"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_circuit_breaker_error_rate: %s", err)
+		}
+		options.ErrorRate = rate
+	}
+	if duration, found, err := environment.LookupDuration("eb_go_lb_circuit_breaker_slow_call_duration"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_circuit_breaker_slow_call_duration: %s", err)
+		}
+		options.SlowCallDuration = duration
+	}
+	if rate, found, err := environment.LookupFloat("eb_go_lb_circuit_breaker_slow_call_rate"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_circuit_breaker_slow_call_rate: %s", err)
+		}
+		options.SlowCallRate = rate
+	}
+	if duration, found, err := environment.LookupDuration("eb_go_lb_circuit_breaker_open_duration"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_circuit_breaker_open_duration: %s", err)
+		}
+		options.OpenDuration = duration
+	}
+	if probes, found, err := environment.LookupInt("eb_go_lb_circuit_breaker_half_open_probes"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_circuit_breaker_half_open_probes: %s", err)
+		}
+		options.HalfOpenProbes = int(probes)
+	}
+	return options, nil
+}
+
+func (options CircuitBreakerOptions) Validate() error {
+	if options.Window < time.Second || options.OpenDuration <= 0 {
+		return errors.New("circuit breaker window must be at least 1s and the open duration positive")
+	}
+	if options.MinRequests < 1 || options.HalfOpenProbes < 1 {
+		return errors.New("circuit breaker min requests and half-open probes must be at least 1")
+	}
+	if options.ErrorRate <= 0 || options.ErrorRate > 1 || options.SlowCallRate <= 0 || options.SlowCallRate > 1 {
+		return errors.New("circuit breaker rates must be in (0, 1]")
+	}
+	if options.SlowCallDuration < 0 {
+		return errors.New("circuit breaker slow call duration must not be negative")
+	}
+	return nil
+}
+
+type BreakerState int
+
+const (
+	Closed BreakerState = iota
+	Open
+	HalfOpen
+)
+
+func (state BreakerState) String() string {
+	switch state {
+	case Closed:
+		return "closed"
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// breakerBucket counts the requests of one second of the rolling window
+type breakerBucket struct {
+	second   int64
+	requests int
+	errors   int
+	slow     int
+}
+
+type breaker struct {
+	state   BreakerState
+	buckets []breakerBucket
+	// probes is the number of admitted probes while half-open, successes the number of successful ones
+	probes    int
+	successes int
+}
+
+func (b *breaker) bucket(now time.Time) *breakerBucket {
+	second := now.Unix()
+	bucket := &b.buckets[second%int64(len(b.buckets))]
+	if bucket.second != second {
+		*bucket = breakerBucket{second: second}
+	}
+	return bucket
+}
+
+// totals sums up the buckets that are within the window
+func (b *breaker) totals(now time.Time) (requests int, errors int, slow int) {
+	oldest := now.Unix() - int64(len(b.buckets)) + 1
+	for _, bucket := range b.buckets {
+		if bucket.second >= oldest {
+			requests += bucket.requests
+			errors += bucket.errors
+			slow += bucket.slow
+		}
+	}
+	return
+}
+
+func (b *breaker) reset() {
+	for i := range b.buckets {
+		b.buckets[i] = breakerBucket{}
+	}
+	b.probes = 0
+	b.successes = 0
+}
+
+// CircuitBreaker keeps a closed/open/half-open circuit breaker per backend ip. Open backends are not available for
+// load balancing, half-open ones only admit a limited number of probe requests.
+type CircuitBreaker struct {
+	options   CircuitBreakerOptions
+	mtx       sync.Mutex
+	breakers  map[string]*breaker
+	listeners []func(ip string, state BreakerState)
+}
+
+func NewCircuitBreaker(options CircuitBreakerOptions) *CircuitBreaker {
+	return &CircuitBreaker{
+		options:  options,
+		breakers: make(map[string]*breaker),
+	}
+}
+
+// Subscribe registers a listener that is called whenever the breaker of a backend changes its state
+func (cb *CircuitBreaker) Subscribe(listener func(ip string, state BreakerState)) {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	cb.listeners = append(cb.listeners, listener)
+}
+
+func (cb *CircuitBreaker) breaker(ip string) *breaker {
+	b, found := cb.breakers[ip]
+	if !found {
+		b = &breaker{
+			state:   Closed,
+			buckets: make([]breakerBucket, int(cb.options.Window/time.Second)),
+		}
+		cb.breakers[ip] = b
+	}
+	return b
+}
+
+// State returns the state of the breaker of the backend
+func (cb *CircuitBreaker) State(ip string) BreakerState {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	if b, found := cb.breakers[ip]; found {
+		return b.state
+	}
+	return Closed
+}
+
+func (cb *CircuitBreaker) Available(_ string, ip string) bool {
+	return cb.State(ip) != Open
+}
+
+func (cb *CircuitBreaker) Admit(_ string, ip string) bool {
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	b, found := cb.breakers[ip]
+	if !found {
+		return true
+	}
+	switch b.state {
+	case Open:
+		return false
+	case HalfOpen:
+		if b.probes >= cb.options.HalfOpenProbes {
+			return false
+		}
+		b.probes++
+		return true
+	default:
+		return true
+	}
+}
+
+func (cb *CircuitBreaker) Observe(_ string, ip string, result loadbalancer.Result) {
+	if errors.Is(result.Err, loadbalancer.ErrSkipped) {
+		// the request has been cancelled, release the probe it may have reserved
+		cb.mtx.Lock()
+		if b, found := cb.breakers[ip]; found && b.state == HalfOpen && b.probes > b.successes {
+			b.probes--
+		}
+		cb.mtx.Unlock()
+		return
+	}
+	now := time.Now()
+	failed := result.Err != nil || result.StatusCode >= 500
+	slow := cb.options.SlowCallDuration > 0 && result.Duration > cb.options.SlowCallDuration
+
+	cb.mtx.Lock()
+	b := cb.breaker(ip)
+	previous := b.state
+	switch b.state {
+	case Closed:
+		bucket := b.bucket(now)
+		bucket.requests++
+		if failed {
+			bucket.errors++
+		}
+		if slow {
+			bucket.slow++
+		}
+		requests, errs, slowCalls := b.totals(now)
+		if requests >= cb.options.MinRequests &&
+			(float64(errs)/float64(requests) >= cb.options.ErrorRate ||
+				(cb.options.SlowCallDuration > 0 && float64(slowCalls)/float64(requests) >= cb.options.SlowCallRate)) {
+			cb.open(ip, b)
+		}
+	case HalfOpen:
+		if failed || slow {
+			cb.open(ip, b)
+		} else {
+			b.successes++
+			if b.successes >= cb.options.HalfOpenProbes {
+				b.state = Closed
+				b.reset()
+			}
+		}
+	}
+	state := b.state
+	listeners := cb.listeners
+	cb.mtx.Unlock()
+
+	if state != previous {
+		cb.notify(listeners, ip, state)
+	}
+}
+
+// Prune forgets the breakers of the backends that are no longer part of any function
+func (cb *CircuitBreaker) Prune(functions map[string]Weights) {
+	ips := make(map[string]bool)
+	for _, weights := range functions {
+		for _, ip := range weights.Ips {
+			ips[ip] = true
+		}
+	}
+	cb.mtx.Lock()
+	defer cb.mtx.Unlock()
+	for ip := range cb.breakers {
+		if !ips[ip] {
+			delete(cb.breakers, ip)
+		}
+	}
+}
+
+// open trips the breaker and schedules the transition to half-open, callers must hold the lock
+func (cb *CircuitBreaker) open(ip string, b *breaker) {
+	b.state = Open
+	b.reset()
+	time.AfterFunc(cb.options.OpenDuration, func() {
+		cb.mtx.Lock()
+		if b.state != Open || cb.breakers[ip] != b {
+			// the breaker has been closed or pruned in the meantime
+			cb.mtx.Unlock()
+			return
+		}
+		b.state = HalfOpen
+		listeners := cb.listeners
+		cb.mtx.Unlock()
+		cb.notify(listeners, ip, HalfOpen)
+	})
+}
+
+func (cb *CircuitBreaker) notify(listeners []func(ip string, state BreakerState), ip string, state BreakerState) {
+	zap.S().Infof("circuit breaker of backend %s is %s", ip, state)
+	for _, listener := range listeners {
+		listener(ip, state)
+	}
+}
@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"testing"
+	"time"
+)
+
+func newTestCircuitBreaker() (*CircuitBreaker, <-chan BreakerState) {
+	options := NewDefaultCircuitBreakerOptions()
+	options.Enabled = true
+	options.MinRequests = 4
+	options.SlowCallDuration = 100 * time.Millisecond
+	options.OpenDuration = 10 * time.Millisecond
+	options.HalfOpenProbes = 2
+	cb := NewCircuitBreaker(options)
+	states := make(chan BreakerState, 10)
+	cb.Subscribe(func(_ string, state BreakerState) {
+		states <- state
+	})
+	return cb, states
+}
+
+func expectState(t *testing.T, states <-chan BreakerState, expect BreakerState) {
+	t.Helper()
+	select {
+	case state := <-states:
+		if state != expect {
+			t.Fatalf("breaker is %s, expected %s", state, expect)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("breaker did not become %s", expect)
+	}
+}
+
+func TestCircuitBreakerTrips(t *testing.T) {
+	slow := loadbalancer.Result{StatusCode: 200, Duration: time.Second}
+	tests := []struct {
+		name    string
+		results []loadbalancer.Result
+		state   BreakerState
+	}{
+		{"error rate", []loadbalancer.Result{success, failure, refused, success}, Open},
+		{"below error rate", []loadbalancer.Result{success, failure, success, success}, Closed},
+		{"too few requests", []loadbalancer.Result{failure, failure, failure}, Closed},
+		{"slow calls", []loadbalancer.Result{slow, success, slow, success}, Open},
+		{"client errors are successes", []loadbalancer.Result{{StatusCode: 404}, {StatusCode: 429}, failure, success}, Closed},
+		{"skipped is ignored", []loadbalancer.Result{failure, skipped, skipped, failure, skipped}, Closed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cb, _ := newTestCircuitBreaker()
+			for _, result := range test.results {
+				cb.Observe("f", "a", result)
+			}
+			if state := cb.State("a"); state != test.state {
+				t.Errorf("breaker is %s, expected %s", state, test.state)
+			}
+			if available := cb.Available("f", "a"); available != (test.state != Open) {
+				t.Errorf("available is %t in state %s", available, test.state)
+			}
+		})
+	}
+}
+
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	tests := []struct {
+		name   string
+		probes []loadbalancer.Result
+		state  BreakerState
+	}{
+		{"successful probes close", []loadbalancer.Result{success, success}, Closed},
+		{"failed probe opens", []loadbalancer.Result{success, failure}, Open},
+		{"slow probe opens", []loadbalancer.Result{{StatusCode: 200, Duration: time.Second}}, Open},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cb, states := newTestCircuitBreaker()
+			for i := 0; i < 4; i++ {
+				cb.Observe("f", "a", failure)
+			}
+			expectState(t, states, Open)
+			if cb.Admit("f", "a") {
+				t.Fatal("open breaker admitted a request")
+			}
+			expectState(t, states, HalfOpen)
+			if !cb.Available("f", "a") {
+				t.Fatal("half-open breaker is not available")
+			}
+			for i := 0; i < 2; i++ {
+				if !cb.Admit("f", "a") {
+					t.Fatalf("probe %d was not admitted", i)
+				}
+			}
+			if cb.Admit("f", "a") {
+				t.Fatal("admitted more probes than configured")
+			}
+			for _, result := range test.probes {
+				cb.Observe("f", "a", result)
+			}
+			expectState(t, states, test.state)
+		})
+	}
+}
+
+func TestCircuitBreakerReleasesSkippedProbes(t *testing.T) {
+	cb, states := newTestCircuitBreaker()
+	for i := 0; i < 4; i++ {
+		cb.Observe("f", "a", failure)
+	}
+	expectState(t, states, Open)
+	expectState(t, states, HalfOpen)
+	cb.Admit("f", "a")
+	cb.Admit("f", "a")
+	cb.Observe("f", "a", skipped)
+	if !cb.Admit("f", "a") {
+		t.Error("the probe of a skipped request was not released")
+	}
+}
+
+func TestCircuitBreakerPrune(t *testing.T) {
+	cb, states := newTestCircuitBreaker()
+	cb.Observe("f", "a", success)
+	for i := 0; i < 4; i++ {
+		cb.Observe("f", "b", failure)
+	}
+	expectState(t, states, Open)
+	cb.Prune(map[string]Weights{"g": {Ips: []string{"a"}, Weights: []int{1}}})
+	if _, found := cb.breakers["a"]; !found {
+		t.Error("breaker of a backend of another function has been pruned")
+	}
+	if _, found := cb.breakers["b"]; found {
+		t.Error("breaker of a removed backend is still tracked")
+	}
+	// the pending transition to half-open of the pruned breaker must not be reported
+	select {
+	case state := <-states:
+		t.Errorf("pruned breaker became %s", state)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
@@ -26,5 +26,9 @@ func (DummyHandler) Handle(res http.ResponseWriter, req *http.Request) {
 }
 
 func (DummyHandler) HandleWeightUpdate(update *WeightUpdate) {
+	if update.Type == Delete {
+		zap.S().Infof("got function removal: %s", update.Function)
+		return
+	}
 	zap.S().Info("got weight update: %s - ips: %s, weights: ", update.Function, update.Weights.Ips, update.Weights.Weights)
 }
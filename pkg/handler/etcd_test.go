@@ -0,0 +1,123 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"go.etcd.io/etcd/clientv3"
+	"go.etcd.io/etcd/mvcc/mvccpb"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestDiffFunctions(t *testing.T) {
+	a := Weights{Ips: []string{"a"}, Weights: []int{1}}
+	b := Weights{Ips: []string{"b"}, Weights: []int{1}}
+	tests := []struct {
+		name    string
+		known   map[string]Weights
+		current map[string]Weights
+		expect  []string
+	}{
+		{"unchanged", map[string]Weights{"f": a}, map[string]Weights{"f": a}, nil},
+		{"added", map[string]Weights{}, map[string]Weights{"f": a}, []string{"put f"}},
+		{"removed", map[string]Weights{"f": a, "g": b}, map[string]Weights{"g": b}, []string{"delete f"}},
+		{"changed", map[string]Weights{"f": a}, map[string]Weights{"f": b}, []string{"put f"}},
+		{"everything", map[string]Weights{"f": a, "g": a}, map[string]Weights{"g": b, "h": a}, []string{"delete f", "put g", "put h"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if updates := describeUpdates(diffFunctions(test.known, test.current)); !reflect.DeepEqual(updates, test.expect) {
+				t.Errorf("got %v, expected %v", updates, test.expect)
+			}
+		})
+	}
+}
+
+// describeUpdates returns the sorted updates as "put <function>" or "delete <function>"
+func describeUpdates(updates []*WeightUpdate) []string {
+	var descriptions []string
+	for _, update := range updates {
+		if update.Type == Delete {
+			descriptions = append(descriptions, fmt.Sprintf("delete %s", update.Function))
+		} else {
+			descriptions = append(descriptions, fmt.Sprintf("put %s", update.Function))
+		}
+	}
+	sort.Strings(descriptions)
+	return descriptions
+}
+
+func putEvent(function string, weights Weights) *clientv3.Event {
+	value, _ := json.Marshal(weights)
+	return &clientv3.Event{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(FunctionKeyPrefix("zone-a") + function), Value: value}}
+}
+
+func deleteEvent(function string) *clientv3.Event {
+	return &clientv3.Event{Type: mvccpb.DELETE, Kv: &mvccpb.KeyValue{Key: []byte(FunctionKeyPrefix("zone-a") + function)}}
+}
+
+func TestEtcdWeightUpdaterResync(t *testing.T) {
+	a := Weights{Ips: []string{"a"}, Weights: []int{1}}
+	b := Weights{Ips: []string{"b"}, Weights: []int{1}}
+	// the updater initially knows f and g with weights a, then watches the events and resyncs with the snapshot
+	tests := []struct {
+		name     string
+		events   []*clientv3.Event
+		snapshot map[string]Weights
+		watched  []string
+		resynced []string
+	}{
+		{"nothing missed", []*clientv3.Event{putEvent("f", b)}, map[string]Weights{"f": b, "g": a}, []string{"put f"}, nil},
+		{"missed put", nil, map[string]Weights{"f": b, "g": a}, nil, []string{"put f"}},
+		{"missed delete", []*clientv3.Event{putEvent("h", a)}, map[string]Weights{"f": a, "h": a}, []string{"put h"}, []string{"delete g"}},
+		{"watched delete", []*clientv3.Event{deleteEvent("g")}, map[string]Weights{"f": a}, []string{"delete g"}, nil},
+		{"invalid events are ignored", []*clientv3.Event{
+			{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte("golb/f"), Value: []byte("{}")}},
+			{Type: mvccpb.PUT, Kv: &mvccpb.KeyValue{Key: []byte(FunctionKeyPrefix("zone-a") + "f"), Value: []byte("not json")}},
+		}, map[string]Weights{"f": a, "g": a}, nil, nil},
+		{"everything removed", nil, map[string]Weights{}, nil, []string{"delete f", "delete g"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			updater := NewEtcdWeightUpdater(nil)
+			updater.known = map[string]Weights{"f": a, "g": a}
+			updates := make(chan *WeightUpdate, 10)
+			for _, event := range test.events {
+				updater.apply(event, updates)
+			}
+			if watched := describeUpdates(drain(updates)); !reflect.DeepEqual(watched, test.watched) {
+				t.Errorf("watch sent %v, expected %v", watched, test.watched)
+			}
+			updater.replace(test.snapshot, 42, updates)
+			if resynced := describeUpdates(drain(updates)); !reflect.DeepEqual(resynced, test.resynced) {
+				t.Errorf("resync sent %v, expected %v", resynced, test.resynced)
+			}
+			if !reflect.DeepEqual(updater.known, test.snapshot) || updater.revision != 42 {
+				t.Errorf("updater knows %v at revision %d after the resync", updater.known, updater.revision)
+			}
+		})
+	}
+}
+
+func drain(updates chan *WeightUpdate) []*WeightUpdate {
+	var drained []*WeightUpdate
+	for len(updates) > 0 {
+		drained = append(drained, <-updates)
+	}
+	return drained
+}
+
+func TestEtcdWeightUpdaterDeleteEvent(t *testing.T) {
+	updater := NewEtcdWeightUpdater(nil)
+	updater.known = map[string]Weights{"f": {Ips: []string{"a"}, Weights: []int{1}}}
+	updates := make(chan *WeightUpdate, 1)
+	updater.apply(deleteEvent("f"), updates)
+
+	if update := drain(updates); len(update) != 1 || !reflect.DeepEqual(update[0], NewFunctionRemoval("f")) {
+		t.Errorf("got updates %+v, expected the removal of f", update)
+	}
+	if _, found := updater.known["f"]; found {
+		t.Error("the updater still knows f")
+	}
+}
@@ -2,41 +2,256 @@ package handler
 
 import (
 	"edgebench/go-load-balancer/pkg/env"
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"errors"
 	"fmt"
 	"go.uber.org/zap"
+	"net"
+	"strings"
 )
 
-func NewHandler(handlerType HandlerType, functionState *FunctionState) Handler {
-	switch handlerType {
-	case Dummy:
-		return NewDummyHandler()
-	case WeightedRR:
-		gateways, err := readGatewaysFromEnv()
+// Options configure the handler that is created by NewHandlerWithOptions
+type Options struct {
+	Type HandlerType `yaml:"handler_type"`
+	// NodeName is used to mark requests that have been forwarded by this load balancer, defaults to $HOSTNAME
+	NodeName string `yaml:"node_name"`
+	// Gateways are the hosts (host or host:port) of the backends that are gateways, in addition to the gateways that
+	// are marked in the weights
+	Gateways []string `yaml:"gateways"`
+	// GatewayNetworks are CIDRs, backends with an address in one of them are gateways, defaults to
+	// DefaultGatewayNetwork. An empty list only uses the hosts and the marks in the weights.
+	GatewayNetworks []string `yaml:"gateway_networks"`
+	// MaxHops is the number of load balancers a request may pass, requests that have passed as many are not sent to
+	// gateways
+	MaxHops int `yaml:"max_hops"`
+	// TrustedProxies are CIDRs or IPs of proxies, e.g., load balancers of other zones, whose Forwarded and
+	// X-Forwarded-* headers are kept. The headers of other clients are replaced. Gateways are always trusted.
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// Strategy holds the options of the load balancing strategy by their variable name without the eb_go_lb_ prefix,
+	// e.g., hash_key
+	Strategy         map[string]string       `yaml:"strategy"`
+	Policies         Policies                `yaml:"policies"`
+	Retry            RetryOptions            `yaml:"retry"`
+	HealthCheck      HealthCheckOptions      `yaml:"health_check"`
+	OutlierDetection OutlierDetectionOptions `yaml:"outlier_detection"`
+	CircuitBreaker   CircuitBreakerOptions   `yaml:"circuit_breaker"`
+	Locality         LocalityOptions         `yaml:"locality"`
+
+	// strategyEnvironment overrides Strategy, see ReadOptions
+	strategyEnvironment env.Environment
+}
+
+func NewDefaultOptions() Options {
+	return Options{
+		Type:             Dummy,
+		GatewayNetworks:  []string{DefaultGatewayNetwork},
+		MaxHops:          DefaultMaxHops,
+		Strategy:         make(map[string]string),
+		Policies:         Policies{Default: NewDefaultFunctionPolicy(), Functions: make(map[string]FunctionPolicy)},
+		Retry:            NewDefaultRetryOptions(),
+		HealthCheck:      NewDefaultHealthCheckOptions(),
+		OutlierDetection: NewDefaultOutlierDetectionOptions(),
+		CircuitBreaker:   NewDefaultCircuitBreakerOptions(),
+		Locality:         NewDefaultLocalityOptions(),
+	}
+}
+
+// ReadOptions overrides the options with the variables of the environment
+func ReadOptions(environment env.Environment, options Options) (Options, error) {
+	var err error
+	if handlerType, found := environment.Lookup("eb_go_lb_handler_type"); found {
+		options.Type = HandlerType(strings.ToLower(handlerType))
+	}
+	if nodeName, found := environment.Lookup("eb_go_lb_node_name"); found {
+		options.NodeName = nodeName
+	}
+	if options.NodeName == "" {
+		options.NodeName = environment.Get("HOSTNAME")
+	}
+	if gateways, found, err := environment.LookupFields("eb_go_lb_gateways"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_gateways: %s", err)
+		}
+		options.Gateways = gateways
+	}
+	if networks, found, err := environment.LookupFields("eb_go_lb_gateway_networks"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_gateway_networks: %s", err)
+		}
+		options.GatewayNetworks = networks
+	}
+	if maxHops, found, err := environment.LookupInt("eb_go_lb_max_hops"); found {
 		if err != nil {
-			panic(fmt.Sprintf("error looking up gateways: %s", err))
+			return options, fmt.Errorf("eb_go_lb_max_hops: %s", err)
 		}
-		zap.S().Info("Read gateways: ")
-		return NewWeightedRoundRobinHandler(gateways, functionState)
-	default:
-		err := fmt.Sprintf("error unknown handlertype: %d", handlerType)
-		panic(err)
+		options.MaxHops = int(maxHops)
 	}
+	if proxies, found, err := environment.LookupFields("eb_go_lb_trusted_proxies"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_trusted_proxies: %s", err)
+		}
+		options.TrustedProxies = proxies
+	}
+	options.strategyEnvironment = env.Layered(environment, options.strategyOptions())
+	if options.Policies, err = ReadPolicies(environment, options.Policies); err != nil {
+		return options, err
+	}
+	if options.Retry, err = ReadRetryOptions(environment, options.Retry); err != nil {
+		return options, err
+	}
+	if options.HealthCheck, err = ReadHealthCheckOptions(environment, options.HealthCheck); err != nil {
+		return options, err
+	}
+	if options.OutlierDetection, err = ReadOutlierDetectionOptions(environment, options.OutlierDetection); err != nil {
+		return options, err
+	}
+	if options.CircuitBreaker, err = ReadCircuitBreakerOptions(environment, options.CircuitBreaker); err != nil {
+		return options, err
+	}
+	if options.Locality, err = ReadLocalityOptions(environment, options.Locality); err != nil {
+		return options, err
+	}
+	return options, nil
+}
 
+func (options Options) strategyOptions() env.MapEnvironment {
+	strategy := make(env.MapEnvironment)
+	for key, value := range options.Strategy {
+		strategy["eb_go_lb_"+key] = value
+	}
+	return strategy
 }
 
-func readGatewaysFromEnv() (map[string]bool, error) {
-	fields, found, err := env.OsEnv.LookupFields("eb_go_lb_gateways")
-	if !found {
-		return make(map[string]bool), nil
+func (options Options) newStrategyFactory() (loadbalancer.Factory, error) {
+	environment := options.strategyEnvironment
+	if environment == nil {
+		environment = options.strategyOptions()
 	}
+	return loadbalancer.NewFactory(string(options.Type), environment)
+}
 
+// Validate returns all problems of the options
+func (options Options) Validate() error {
+	var errs []error
+	if options.Type != Dummy {
+		if _, found := loadbalancer.Lookup(string(options.Type)); !found {
+			errs = append(errs, fmt.Errorf("unknown handler type '%s', expected dummy or one of %s", options.Type, strings.Join(loadbalancer.Names(), ", ")))
+		} else if _, err := options.newStrategyFactory(); err != nil {
+			errs = append(errs, fmt.Errorf("strategy: %s", err))
+		}
+	}
+	for _, gateway := range options.Gateways {
+		if strings.Contains(gateway, "/") {
+			errs = append(errs, fmt.Errorf("gateway '%s' must be a host or host:port like the ips of the weights, not a URL", gateway))
+		}
+	}
+	for _, network := range options.GatewayNetworks {
+		if _, _, err := net.ParseCIDR(network); err != nil {
+			errs = append(errs, fmt.Errorf("gateway network '%s' must be a CIDR like 10.0.0.0/16", network))
+		}
+	}
+	if _, err := parseNetworks(options.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("trusted proxy %s", err))
+	}
+	if options.MaxHops < 1 {
+		errs = append(errs, fmt.Errorf("max hops must be at least 1, got %d", options.MaxHops))
+	}
+	sections := []struct {
+		name string
+		err  error
+	}{
+		{"policies", options.Policies.Validate()},
+		{"retry", options.Retry.Validate()},
+		{"health_check", options.HealthCheck.Validate()},
+		{"outlier_detection", options.OutlierDetection.Validate()},
+		{"circuit_breaker", options.CircuitBreaker.Validate()},
+		{"locality", options.Locality.Validate()},
+	}
+	for _, section := range sections {
+		if section.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", section.name, section.err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func NewHandlerWithOptions(functionState *FunctionState, options Options) (Handler, error) {
+	return NewHandlerFromPrevious(functionState, options, nil)
+}
+
+// NewHandlerFromPrevious creates a handler that replaces previous, e.g., on a reload. It takes over the strategies, the
+// health checker, the outlier detector and the circuit breaker of previous whose options did not change, so the
+// backends keep their state. previous may be nil and keeps working until it is closed.
+func NewHandlerFromPrevious(functionState *FunctionState, options Options, previous Handler) (Handler, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	if options.Type == Dummy {
+		return NewDummyHandler(), nil
+	}
+
+	factory, err := options.newStrategyFactory()
+	if err != nil {
+		return nil, fmt.Errorf("error creating load balancing strategy: %s", err)
+	}
+	gateways, err := NewGatewayMatcher(options.Gateways, options.GatewayNetworks)
 	if err != nil {
 		return nil, err
 	}
+	zap.S().Infow("Read gateways", "gateways", options.Gateways, "networks", options.GatewayNetworks)
+	trustedProxies, err := parseNetworks(options.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	trustedProxies = append(trustedProxies, gateways.peers()...)
+	handler := newWeightedRoundRobinHandler(newForwarder(options.NodeName, functionState.Zone, options.MaxHops, trustedProxies), gateways, options.Locality, functionState, factory, options.Policies, options.Retry)
+	handler.options = options
+	previousHandler, _ := previous.(*WeightedRoundRobinHandler)
+	if previousHandler != nil {
+		handler.takeOver(previousHandler)
+	}
 
-	gateways := make(map[string]bool)
-	for _, field := range fields {
-		gateways[field] = true
+	if options.HealthCheck.Enabled {
+		c := previousHandler.component(options.HealthCheck)
+		if c == nil {
+			healthCheckOptions := options.HealthCheck
+			zap.S().Infow("Start health checks", "path", healthCheckOptions.Path, "interval", healthCheckOptions.Interval)
+			checker := NewHealthChecker(functionState, healthCheckOptions)
+			c = newComponent(healthCheckOptions, checker, checker.Stop)
+			checker.Subscribe(func(ip string, _ bool) {
+				c.refreshBackend(ip)
+			})
+			go checker.Run()
+		}
+		handler.use(c)
+	}
+
+	if options.OutlierDetection.Enabled {
+		c := previousHandler.component(options.OutlierDetection)
+		if c == nil {
+			outlierOptions := options.OutlierDetection
+			zap.S().Infow("Enable outlier detection", "consecutiveErrors", outlierOptions.ConsecutiveErrors)
+			detector := NewOutlierDetector(functionState, outlierOptions)
+			c = newComponent(outlierOptions, detector, nil)
+			detector.Subscribe(func(ip string, _ bool) {
+				c.refreshBackend(ip)
+			})
+		}
+		handler.use(c)
+	}
+
+	if options.CircuitBreaker.Enabled {
+		c := previousHandler.component(options.CircuitBreaker)
+		if c == nil {
+			breakerOptions := options.CircuitBreaker
+			zap.S().Infow("Enable circuit breakers", "window", breakerOptions.Window, "errorRate", breakerOptions.ErrorRate)
+			breaker := NewCircuitBreaker(breakerOptions)
+			c = newComponent(breakerOptions, breaker, nil)
+			breaker.Subscribe(func(ip string, _ BreakerState) {
+				c.refreshBackend(ip)
+			})
+		}
+		handler.use(c)
 	}
-	return gateways, nil
+	return handler, nil
 }
@@ -0,0 +1,31 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"errors"
+	"testing"
+)
+
+// fieldsErrorEnvironment fails to look up the list of key
+type fieldsErrorEnvironment struct {
+	env.MapEnvironment
+	key string
+}
+
+func (environment fieldsErrorEnvironment) LookupFields(key string) ([]string, bool, error) {
+	if key == environment.key {
+		return nil, true, errors.New("invalid list")
+	}
+	return environment.MapEnvironment.LookupFields(key)
+}
+
+func TestReadOptionsReportsLookupErrors(t *testing.T) {
+	for _, key := range []string{"eb_go_lb_gateways", "eb_go_lb_gateway_networks", "eb_go_lb_trusted_proxies"} {
+		t.Run(key, func(t *testing.T) {
+			_, err := ReadOptions(fieldsErrorEnvironment{env.MapEnvironment{}, key}, NewDefaultOptions())
+			if expect := key + ": invalid list"; err == nil || err.Error() != expect {
+				t.Errorf("got error %v, expected '%s'", err, expect)
+			}
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// forwarder contains the proxy logic shared by all handlers that route function calls to backend ips
+type forwarder struct {
+	NodeName string
+	Zone     string
+	// MaxHops is the number of load balancers a request may pass
+	MaxHops int
+	// TrustedProxies are the networks of proxies whose forwarded headers are kept
+	TrustedProxies networks
+}
+
+func newForwarder(nodeName string, zone string, maxHops int, trustedProxies networks) forwarder {
+	return forwarder{
+		NodeName:       nodeName,
+		Zone:           zone,
+		MaxHops:        maxHops,
+		TrustedProxies: trustedProxies,
+	}
+}
+
+// parseFunction extracts the function name from urls like:
+// localhost:8080/function/nginx
+// localhost:8080/function/responder/static?time=10
+func parseFunction(req *http.Request) (string, error) {
+	uri := req.URL.RequestURI()
+	split := strings.Split(uri, "/")
+	if len(split) != 3 && len(split) != 4 {
+		return "", fmt.Errorf("invalid URL format: %s\n", uri)
+	}
+
+	if split[1] != "function" {
+		return "", fmt.Errorf("not a function call: %s\n", uri)
+	}
+
+	return split[2], nil
+}
+
+var errNoAvailableServers = errors.New("no available servers")
+
+func writeSelectError(res http.ResponseWriter, err error, zone string) {
+	text := fmt.Sprintf("error selecting server: %s - in %s", err, zone)
+	zap.S().Info(text)
+	if errors.Is(err, errNoAvailableServers) {
+		res.WriteHeader(http.StatusServiceUnavailable)
+	} else {
+		res.WriteHeader(404)
+	}
+	res.Write([]byte(text))
+}
+
+// writeLastFailure answers with the failure of an attempt that has not been written because it could have been retried,
+// 502 for connection errors and the status of the backend otherwise
+func writeLastFailure(res http.ResponseWriter, route string, result loadbalancer.Result) {
+	res.Header().Set(RouteHeader, route)
+	if result.Err != nil || result.StatusCode == 0 {
+		res.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	res.WriteHeader(result.StatusCode)
+}
+
+// statusRecorder remembers the status code that has been written to the client
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// retryableStatusError signals that a response has been discarded because its status allows to retry the request
+type retryableStatusError struct {
+	status int
+}
+
+func (err *retryableStatusError) Error() string {
+	return fmt.Sprintf("retryable status %d", err.status)
+}
+
+// functionUrl returns the url of a function backend, which only receives the parameters after '/function/<function>/'.
+// Gateways receive the unchanged url.
+func functionUrl(uri string, host string) *url.URL {
+	split := strings.Split(uri, "/")
+	params := ""
+	if len(split) == 4 {
+		params = split[3]
+	}
+	parsed, _ := url.Parse(fmt.Sprintf("http://%s/%s", host, params))
+	return parsed
+}
+
+// forward proxies the request to the given ip and blocks until the response has been written. Gateways receive the
+// unchanged url. If retryStatuses is not nil, nothing is written to res in case of a connection error or a response
+// with one of the statuses, so the caller can send the request to another backend. transport may be nil to use
+// http.DefaultTransport.
+func (f *forwarder) forward(res http.ResponseWriter, req *http.Request, ip string, gateway bool, retryStatuses map[int]bool, transport http.RoundTripper) loadbalancer.Result {
+	start := time.Now()
+	target := fmt.Sprintf("http://%s", ip)
+	parsedUrl, _ := url.Parse(target)
+	route := routeOf(req, ip)
+
+	// Update the headers to allow for SSL redirection
+	req.URL.Host = parsedUrl.Host
+
+	if !gateway {
+		req.URL = functionUrl(req.URL.RequestURI(), parsedUrl.Host)
+		target = req.URL.String()
+		req.RequestURI = target
+	}
+	proxy := httputil.NewSingleHostReverseProxy(parsedUrl)
+	proxy.Transport = transport
+	var proxyErr error
+	statusCode := 0
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// a hedged request may have been answered by another backend than ip
+		if resp.Request != nil && resp.Request.URL.Host != parsedUrl.Host {
+			res.Header().Set("X-Final-Host", resp.Request.URL.Host)
+			route = routeOf(req, resp.Request.URL.Host)
+		}
+		// a gateway has already set the complete route
+		if resp.Header.Get(RouteHeader) == "" {
+			resp.Header.Set(RouteHeader, route)
+		}
+		if retryStatuses[resp.StatusCode] {
+			return &retryableStatusError{resp.StatusCode}
+		}
+		return nil
+	}
+	proxy.ErrorHandler = func(res http.ResponseWriter, req *http.Request, err error) {
+		var statusErr *retryableStatusError
+		if errors.As(err, &statusErr) {
+			statusCode = statusErr.status
+			return
+		}
+		proxyErr = err
+		zap.S().Infof("error proxying request to %s: %s", parsedUrl.Host, err)
+		if retryStatuses == nil {
+			res.Header().Set(RouteHeader, route)
+			res.WriteHeader(http.StatusBadGateway)
+		}
+	}
+	//req.URL.Scheme = parsedUrl.Scheme
+	res.Header().Set("X-Final-Host", parsedUrl.Host)
+	req.Header.Set("X-Final-Host", parsedUrl.Host)
+	req.Host = parsedUrl.Host
+	zap.S().Debug("direct request ", req.RequestURI, " to ", target)
+	recorder := &statusRecorder{ResponseWriter: res}
+	proxy.ServeHTTP(recorder, req)
+	if recorder.status != 0 {
+		statusCode = recorder.status
+	}
+	return loadbalancer.Result{
+		StatusCode: statusCode,
+		Duration:   time.Since(start),
+		Err:        proxyErr,
+	}
+}
@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// networks is a list of IP networks, e.g., of trusted proxies
+type networks []*net.IPNet
+
+// parseNetworks parses CIDRs like 10.0.0.0/16 and single IPs
+func parseNetworks(cidrs []string) (networks, error) {
+	var parsed networks
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("'%s' is neither a CIDR nor an IP", cidr)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			parsed = append(parsed, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("'%s' is neither a CIDR nor an IP", cidr)
+		}
+		parsed = append(parsed, network)
+	}
+	return parsed, nil
+}
+
+func (n networks) contains(ip net.IP) bool {
+	for _, network := range n {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedHeaders are the headers that describe the client of a request and the proxies it has passed
+var forwardedHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Proto", "X-Forwarded-Host"}
+
+// internalHeaders are the headers that load balancers exchange, they are only accepted from trusted proxies
+var internalHeaders = []string{HopsHeader, RouteHeader}
+
+// remoteIp returns the ip of the peer that sent the request
+func remoteIp(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// forwardedNode formats an ip as node of the Forwarded header, IPv6 addresses are quoted, see RFC 7239 section 6
+func forwardedNode(ip net.IP) string {
+	if ip == nil {
+		return "unknown"
+	}
+	if ip.To4() == nil {
+		return fmt.Sprintf("\"[%s]\"", ip)
+	}
+	return ip.String()
+}
+
+// trusted returns whether the peer that sent the request is a trusted proxy
+func (f *forwarder) trusted(req *http.Request) bool {
+	ip := remoteIp(req)
+	return ip != nil && f.TrustedProxies.contains(ip)
+}
+
+// removeUntrustedHeaders removes the internal headers of requests that do not come from a trusted proxy, so that a
+// client can neither fake its hops nor provoke a 508. It returns whether hops have been removed, i.e., whether the
+// request may have been forwarded by a load balancer that is not trusted.
+func (f *forwarder) removeUntrustedHeaders(req *http.Request) bool {
+	if f.trusted(req) {
+		return false
+	}
+	hops := req.Header.Get(HopsHeader) != ""
+	for _, header := range internalHeaders {
+		req.Header.Del(header)
+	}
+	return hops
+}
+
+// setForwardedHeaders describes the client of the request for the backends. The headers of trusted proxies are
+// extended, the headers of other clients are replaced. Forwarded gets a new element (RFC 7239), X-Forwarded-Proto and
+// X-Forwarded-Host keep the values of the first proxy. The client ip is appended to X-Forwarded-For by the reverse
+// proxy.
+func (f *forwarder) setForwardedHeaders(req *http.Request) {
+	ip := remoteIp(req)
+	if !f.trusted(req) {
+		for _, header := range forwardedHeaders {
+			req.Header.Del(header)
+		}
+	}
+
+	proto := "http"
+	if req.TLS != nil {
+		proto = "https"
+	}
+	element := fmt.Sprintf("for=%s;host=%q;proto=%s", forwardedNode(ip), req.Host, proto)
+	if forwarded := strings.Join(req.Header.Values("Forwarded"), ", "); forwarded != "" {
+		element = fmt.Sprintf("%s, %s", forwarded, element)
+	}
+	req.Header.Set("Forwarded", element)
+	if req.Header.Get("X-Forwarded-Proto") == "" {
+		req.Header.Set("X-Forwarded-Proto", proto)
+	}
+	if req.Header.Get("X-Forwarded-Host") == "" {
+		req.Header.Set("X-Forwarded-Host", req.Host)
+	}
+}
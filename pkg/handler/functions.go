@@ -1,17 +1,64 @@
 package handler
 
-import "go.uber.org/zap"
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
 
+// FunctionState holds the weights of the functions of a zone. Every update replaces the map of functions with an
+// updated copy, so readers never have to lock and must not modify the map.
 type FunctionState struct {
 	Zone      string
-	Functions map[string]Weights
+	mtx       sync.Mutex
+	functions atomic.Pointer[map[string]Weights]
 }
 
 func NewFunctionState(zone string) *FunctionState {
-	return &FunctionState{
-		Zone:      zone,
-		Functions: make(map[string]Weights),
+	state := &FunctionState{
+		Zone: zone,
 	}
+	functions := make(map[string]Weights)
+	state.functions.Store(&functions)
+	return state
+}
+
+// Functions returns the current weights of all functions, the map must not be modified
+func (state *FunctionState) Functions() map[string]Weights {
+	return *state.functions.Load()
+}
+
+func (state *FunctionState) Function(function string) (Weights, bool) {
+	weights, found := state.Functions()[function]
+	return weights, found
+}
+
+func (state *FunctionState) Put(function string, weights Weights) {
+	state.update(func(functions map[string]Weights) {
+		functions[function] = weights
+	})
+}
+
+func (state *FunctionState) Remove(function string) {
+	state.update(func(functions map[string]Weights) {
+		delete(functions, function)
+	})
+}
+
+func (state *FunctionState) update(change func(functions map[string]Weights)) {
+	state.mtx.Lock()
+	defer state.mtx.Unlock()
+	current := state.Functions()
+	functions := make(map[string]Weights, len(current)+1)
+	for function, weights := range current {
+		functions[function] = weights
+	}
+	change(functions)
+	state.functions.Store(&functions)
+}
+
+func (state *FunctionState) String() string {
+	return fmt.Sprintf("{Zone: %s, Functions: %v}", state.Zone, state.Functions())
 }
 
 type EtcdFunctionStateManager struct {
@@ -27,28 +74,9 @@ func NewEtcdFunctionStateManager(functionState *FunctionState) *EtcdFunctionStat
 
 func (manager *EtcdFunctionStateManager) HandleWeightUpdate(update *WeightUpdate) {
 	state := manager.FunctionState
-	state.Functions[update.Function] = update.Weights
-}
-
-func UpdateFunctionState(state *FunctionState) {
-	etcdClient, err := NewEtcdClientFromEnv()
-	if err != nil {
-		panic(err)
-	}
-	freshState, err := etcdClient.GetFunctionState(state.Zone)
-	if err != nil {
-		zap.S().Error(err)
+	if update.Type == Delete {
+		state.Remove(update.Function)
 		return
 	}
-
-	if freshState == nil {
-		zap.S().Debugf("No state found for zone %s", state.Zone)
-		return
-	}
-
-	for function, _ := range freshState.Functions {
-		state.Functions[function] = freshState.Functions[function]
-	}
-
-	zap.S().Info("Updated Functionstate: ", state)
+	state.Put(update.Function, update.Weights)
 }
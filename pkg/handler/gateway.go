@@ -0,0 +1,83 @@
+package handler
+
+import (
+	"fmt"
+	"net"
+)
+
+// DefaultGatewayNetwork is the network of the gateways in deployments of earlier versions, which treated all backends
+// in 10.0.x.x as gateways
+const DefaultGatewayNetwork = "10.0.0.0/16"
+
+// GatewayMatcher decides which backends are gateways, i.e., load balancers of other zones. A backend is a gateway if
+// it is marked in the weights, if it is one of the configured hosts or if its address is part of one of the configured
+// networks. Requests to gateways keep their url, and requests that have already been forwarded by another load
+// balancer are not sent to gateways again.
+type GatewayMatcher struct {
+	hosts    map[string]bool
+	networks networks
+}
+
+func NewGatewayMatcher(hosts []string, cidrs []string) (*GatewayMatcher, error) {
+	matcher := &GatewayMatcher{
+		hosts: make(map[string]bool),
+	}
+	for _, host := range hosts {
+		matcher.hosts[host] = true
+	}
+	parsed, err := parseNetworks(cidrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gateway network: %s", err)
+	}
+	matcher.networks = parsed
+	return matcher, nil
+}
+
+// matches returns whether the address, with or without port, is a configured gateway
+func (matcher *GatewayMatcher) matches(address string) bool {
+	if matcher == nil {
+		return false
+	}
+	if matcher.hosts[address] {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if matcher.hosts[host] {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && matcher.networks.contains(ip)
+}
+
+// peers returns the networks of the configured gateways, including the addresses of the hosts that are IPs. Gateways
+// are load balancers of other zones, so their hops and forwarded headers are trusted.
+func (matcher *GatewayMatcher) peers() networks {
+	if matcher == nil {
+		return nil
+	}
+	peers := append(networks{}, matcher.networks...)
+	for address := range matcher.hosts {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			host = address
+		}
+		if ip, err := parseNetworks([]string{host}); err == nil {
+			peers = append(peers, ip...)
+		}
+	}
+	return peers
+}
+
+// Gateways returns the set of the backends that are gateways
+func (matcher *GatewayMatcher) Gateways(weights Weights) map[string]bool {
+	gateways := make(map[string]bool)
+	for i, ip := range weights.Ips {
+		if weights.IsGateway(i) || matcher.matches(ip) {
+			gateways[ip] = true
+		}
+	}
+	return gateways
+}
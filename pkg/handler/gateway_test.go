@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestGatewayMatcher(t *testing.T) {
+	matcher, err := NewGatewayMatcher([]string{"192.0.2.1:8080", "198.51.100.1", "gateway.example.com"}, []string{DefaultGatewayNetwork})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		ip      string
+		marked  bool
+		gateway bool
+	}{
+		{"host with port", "192.0.2.1:8080", false, true},
+		{"host with another port", "192.0.2.1:8081", false, false},
+		{"host without port", "198.51.100.1:8080", false, true},
+		{"host name", "gateway.example.com:80", false, true},
+		{"network", "10.0.3.4:8080", false, true},
+		{"outside the network", "10.1.3.4:8080", false, false},
+		{"marked in the weights", "203.0.113.1:8080", true, true},
+		{"pod", "203.0.113.1:8080", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			weights := Weights{Ips: []string{test.ip}, Weights: []int{1}, Gateways: []bool{test.marked}}
+			if gateway := matcher.Gateways(weights)[test.ip]; gateway != test.gateway {
+				t.Errorf("%s is a gateway: %t, expected %t", test.ip, gateway, test.gateway)
+			}
+		})
+	}
+
+	var none *GatewayMatcher
+	if gateways := none.Gateways(Weights{Ips: []string{"10.0.0.1"}, Weights: []int{1}}); len(gateways) != 0 {
+		t.Errorf("a nil matcher found gateways %v", gateways)
+	}
+	if _, err := NewGatewayMatcher(nil, []string{"10.0.0.0/33"}); err == nil {
+		t.Error("expected an error for an invalid network")
+	}
+}
+
+func TestDefaultGatewayNetwork(t *testing.T) {
+	options := NewDefaultOptions()
+	if !reflect.DeepEqual(options.GatewayNetworks, []string{"10.0.0.0/16"}) {
+		t.Errorf("gateway networks default to %v", options.GatewayNetworks)
+	}
+	if err := options.Validate(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestGatewaysReceiveTheUnchangedUrl(t *testing.T) {
+	gatewayUris, podUris := make(chan string, 1), make(chan string, 1)
+	gateway := newTestBackend(t, recordUri(false, gatewayUris))
+	pod := newTestBackend(t, recordUri(false, podUris))
+	inFlight := &inFlightCounts{counts: make(map[string]int)}
+	handler := newTestHandler(newStickyFactory(inFlight), FunctionPolicy{RetryAttempts: 1}, nil)
+	handler.gateways, _ = NewGatewayMatcher([]string{gateway}, nil)
+
+	tests := []struct {
+		name    string
+		backend string
+		uris    chan string
+		uri     string
+	}{
+		{"gateway", gateway, gatewayUris, "/function/f/predict?x=1"},
+		{"pod", pod, podUris, "/predict?x=1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler.HandleWeightUpdate(NewWeightUpdate("f", Weights{Ips: []string{test.backend}, Weights: []int{1}}))
+			res := httptest.NewRecorder()
+			handler.Handle(res, httptest.NewRequest(http.MethodGet, "/function/f/predict?x=1", nil))
+			if res.Code != http.StatusOK {
+				t.Fatalf("got status %d", res.Code)
+			}
+			if uri := <-test.uris; uri != test.uri {
+				t.Errorf("%s received %s, expected %s", test.backend, uri, test.uri)
+			}
+		})
+	}
+}
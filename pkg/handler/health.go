@@ -0,0 +1,239 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// BackendFilter excludes backends from load balancing, e.g., because they are unhealthy
+type BackendFilter interface {
+	Available(function string, ip string) bool
+}
+
+// BackendPruner keeps state per backend and is told about the current backends whenever the weights change, so that
+// the state of removed backends can be dropped
+type BackendPruner interface {
+	Prune(functions map[string]Weights)
+}
+
+type HealthCheckOptions struct {
+	Enabled bool `yaml:"enabled"`
+	// Path that is requested on every backend, any response with a status code below 500 counts as success
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// HealthyThreshold is the number of consecutive successful probes until an unhealthy backend is healthy again
+	HealthyThreshold int `yaml:"healthy_threshold"`
+	// UnhealthyThreshold is the number of consecutive failed probes until a backend is unhealthy
+	UnhealthyThreshold int `yaml:"unhealthy_threshold"`
+}
+
+func NewDefaultHealthCheckOptions() HealthCheckOptions {
+	return HealthCheckOptions{
+		Enabled:            false,
+		Path:               "/",
+		Interval:           5 * time.Second,
+		Timeout:            1 * time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 3,
+	}
+}
+
+// ReadHealthCheckOptions overrides the options with the eb_go_lb_health_check* variables of the environment
+func ReadHealthCheckOptions(environment env.Environment, options HealthCheckOptions) (HealthCheckOptions, error) {
+	if enabled, found, err := environment.LookupBool("eb_go_lb_health_check"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_health_check: %s", err)
+		}
+		options.Enabled = enabled
+	}
+	if path, found := environment.Lookup("eb_go_lb_health_check_path"); found {
+		options.Path = path
+	}
+	if interval, found, err := environment.LookupDuration("eb_go_lb_health_check_interval"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_health_check_interval: %s", err)
+		}
+		options.Interval = interval
+	}
+	if timeout, found, err := environment.LookupDuration("eb_go_lb_health_check_timeout"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_health_check_timeout: %s", err)
+		}
+		options.Timeout = timeout
+	}
+	if threshold, found, err := environment.LookupInt("eb_go_lb_health_check_healthy_threshold"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_health_check_healthy_threshold: %s", err)
+		}
+		options.HealthyThreshold = int(threshold)
+	}
+	if threshold, found, err := environment.LookupInt("eb_go_lb_health_check_unhealthy_threshold"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_health_check_unhealthy_threshold: %s", err)
+		}
+		options.UnhealthyThreshold = int(threshold)
+	}
+	return options, nil
+}
+
+func (options HealthCheckOptions) Validate() error {
+	if options.Interval <= 0 || options.Timeout <= 0 {
+		return fmt.Errorf("health check interval and timeout must be positive")
+	}
+	if options.HealthyThreshold < 1 || options.UnhealthyThreshold < 1 {
+		return fmt.Errorf("health check thresholds must be at least 1")
+	}
+	return nil
+}
+
+type backendHealth struct {
+	healthy   bool
+	successes int
+	failures  int
+}
+
+// HealthChecker periodically probes every ip of the FunctionState. Backends are considered healthy until they failed
+// UnhealthyThreshold probes in a row.
+type HealthChecker struct {
+	functionState *FunctionState
+	options       HealthCheckOptions
+	client        *http.Client
+	mtx           sync.RWMutex
+	backends      map[string]*backendHealth
+	listeners     []func(ip string, healthy bool)
+	stop          chan struct{}
+}
+
+func NewHealthChecker(functionState *FunctionState, options HealthCheckOptions) *HealthChecker {
+	return &HealthChecker{
+		functionState: functionState,
+		options:       options,
+		client: &http.Client{
+			Timeout: options.Timeout,
+		},
+		backends: make(map[string]*backendHealth),
+		stop:     make(chan struct{}),
+	}
+}
+
+// Subscribe registers a listener that is called whenever a backend changes between healthy and unhealthy
+func (checker *HealthChecker) Subscribe(listener func(ip string, healthy bool)) {
+	checker.mtx.Lock()
+	defer checker.mtx.Unlock()
+	checker.listeners = append(checker.listeners, listener)
+}
+
+func (checker *HealthChecker) Available(_ string, ip string) bool {
+	checker.mtx.RLock()
+	defer checker.mtx.RUnlock()
+	backend, found := checker.backends[ip]
+	return !found || backend.healthy
+}
+
+// Run probes the backends until Stop is called
+func (checker *HealthChecker) Run() {
+	ticker := time.NewTicker(checker.options.Interval)
+	defer ticker.Stop()
+	for {
+		checker.checkAll()
+		select {
+		case <-ticker.C:
+		case <-checker.stop:
+			return
+		}
+	}
+}
+
+func (checker *HealthChecker) Stop() {
+	close(checker.stop)
+}
+
+func (checker *HealthChecker) targets() map[string]bool {
+	ips := make(map[string]bool)
+	for _, weights := range checker.functionState.Functions() {
+		for _, ip := range weights.Ips {
+			ips[ip] = true
+		}
+	}
+	return ips
+}
+
+func (checker *HealthChecker) checkAll() {
+	ips := checker.targets()
+
+	checker.mtx.Lock()
+	for ip := range checker.backends {
+		if !ips[ip] {
+			delete(checker.backends, ip)
+		}
+	}
+	checker.mtx.Unlock()
+
+	wg := sync.WaitGroup{}
+	for ip := range ips {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+			checker.record(ip, checker.probe(ip))
+		}(ip)
+	}
+	wg.Wait()
+}
+
+func (checker *HealthChecker) probe(ip string) error {
+	resp, err := checker.client.Get(fmt.Sprintf("http://%s%s", ip, checker.options.Path))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (checker *HealthChecker) record(ip string, err error) {
+	checker.mtx.Lock()
+	backend, found := checker.backends[ip]
+	if !found {
+		backend = &backendHealth{healthy: true}
+		checker.backends[ip] = backend
+	}
+
+	changed := false
+	if err == nil {
+		backend.failures = 0
+		backend.successes++
+		if !backend.healthy && backend.successes >= checker.options.HealthyThreshold {
+			backend.healthy = true
+			changed = true
+		}
+	} else {
+		backend.successes = 0
+		backend.failures++
+		if backend.healthy && backend.failures >= checker.options.UnhealthyThreshold {
+			backend.healthy = false
+			changed = true
+		}
+	}
+	healthy := backend.healthy
+	listeners := checker.listeners
+	checker.mtx.Unlock()
+
+	if !changed {
+		return
+	}
+	if healthy {
+		zap.S().Infof("backend %s is healthy again", ip)
+	} else {
+		zap.S().Infof("backend %s is unhealthy: %s", ip, err)
+	}
+	for _, listener := range listeners {
+		listener(ip, healthy)
+	}
+}
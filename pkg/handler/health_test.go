@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckerThresholds(t *testing.T) {
+	probeFailed := errors.New("status 503")
+	tests := []struct {
+		name    string
+		probes  []error
+		healthy bool
+		changes []bool
+	}{
+		{"healthy until probed", nil, true, nil},
+		{"too few failures", []error{probeFailed, probeFailed}, true, nil},
+		{"unhealthy", []error{probeFailed, probeFailed, probeFailed}, false, []bool{false}},
+		{"success resets failures", []error{probeFailed, probeFailed, nil, probeFailed, probeFailed}, true, nil},
+		{"too few successes", []error{probeFailed, probeFailed, probeFailed, nil}, false, []bool{false}},
+		{"recovered", []error{probeFailed, probeFailed, probeFailed, nil, nil}, true, []bool{false, true}},
+		{"failure resets successes", []error{probeFailed, probeFailed, probeFailed, nil, probeFailed, nil}, false, []bool{false}},
+		{"notified once", []error{probeFailed, probeFailed, probeFailed, probeFailed, probeFailed}, false, []bool{false}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			options := NewDefaultHealthCheckOptions()
+			options.HealthyThreshold = 2
+			options.UnhealthyThreshold = 3
+			checker := NewHealthChecker(NewFunctionState("zone-a"), options)
+			var changes []bool
+			checker.Subscribe(func(ip string, healthy bool) {
+				if ip != "a" {
+					t.Errorf("got a change of %s", ip)
+				}
+				changes = append(changes, healthy)
+			})
+			for _, err := range test.probes {
+				checker.record("a", err)
+			}
+			if healthy := checker.Available("f", "a"); healthy != test.healthy {
+				t.Errorf("healthy is %t, expected %t", healthy, test.healthy)
+			}
+			if !reflect.DeepEqual(changes, test.changes) {
+				t.Errorf("got changes %v, expected %v", changes, test.changes)
+			}
+			if !checker.Available("f", "b") {
+				t.Error("b has not been probed and must be healthy")
+			}
+		})
+	}
+}
+
+// waitForIps waits until the available backends of the function are the expected ones
+func waitForIps(t *testing.T, handler *WeightedRoundRobinHandler, function string, expect []string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !reflect.DeepEqual(availableIps(handler, function), expect) {
+		if time.Now().After(deadline) {
+			t.Fatalf("available are %v, expected %v", availableIps(handler, function), expect)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthCheckRemovesUnhealthyBackends(t *testing.T) {
+	var status atomic.Int64
+	status.Store(http.StatusOK)
+	var requests atomic.Int64
+	switching := newTestBackend(t, func(res http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/health" {
+			requests.Add(1)
+		}
+		res.WriteHeader(int(status.Load()))
+	})
+	healthy := newTestBackend(t, respondWith(http.StatusOK))
+
+	functionState := NewFunctionState("zone-a")
+	functionState.Put("f", Weights{Ips: []string{switching, healthy}, Weights: []int{1, 1}})
+	options := NewDefaultOptions()
+	options.Type = "wrr"
+	options.HealthCheck = HealthCheckOptions{
+		Enabled:            true,
+		Path:               "/health",
+		Interval:           10 * time.Millisecond,
+		Timeout:            time.Second,
+		HealthyThreshold:   2,
+		UnhealthyThreshold: 2,
+	}
+	handler := newReloadedHandler(t, functionState, options, nil)
+
+	status.Store(http.StatusInternalServerError)
+	waitForIps(t, handler, "f", []string{healthy})
+	// requests never reach the unhealthy backend
+	for i := 0; i < 10; i++ {
+		res := httptest.NewRecorder()
+		handler.Handle(res, httptest.NewRequest(http.MethodGet, "/function/f/", nil))
+		if res.Code != http.StatusOK {
+			t.Fatalf("got status %d, expected the healthy backend to answer", res.Code)
+		}
+	}
+	if sent := requests.Load(); sent != 0 {
+		t.Errorf("sent %d requests to the unhealthy backend", sent)
+	}
+
+	// client errors count as healthy, so the backend recovers
+	status.Store(http.StatusNotFound)
+	waitForIps(t, handler, "f", []string{switching, healthy})
+}
@@ -0,0 +1,270 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"edgebench/go-load-balancer/pkg/tracing"
+	"go.uber.org/zap"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	latencyWindowSize = 200
+	// minLatencySamples is the number of observed latencies that is needed to calculate percentiles
+	minLatencySamples = 20
+)
+
+// latencyWindow keeps the most recent latencies of a function
+type latencyWindow struct {
+	mtx       sync.Mutex
+	latencies []time.Duration
+	next      int
+}
+
+func (window *latencyWindow) observe(latency time.Duration) {
+	window.mtx.Lock()
+	defer window.mtx.Unlock()
+	if len(window.latencies) < latencyWindowSize {
+		window.latencies = append(window.latencies, latency)
+		return
+	}
+	window.latencies[window.next] = latency
+	window.next = (window.next + 1) % latencyWindowSize
+}
+
+// percentile returns false if not enough latencies have been observed
+func (window *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	window.mtx.Lock()
+	if len(window.latencies) < minLatencySamples {
+		window.mtx.Unlock()
+		return 0, false
+	}
+	sorted := make([]time.Duration, len(window.latencies))
+	copy(sorted, window.latencies)
+	window.mtx.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] < sorted[j]
+	})
+	index := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if index < 0 {
+		index = 0
+	}
+	return sorted[index], true
+}
+
+type hedgedResponse struct {
+	ip       string
+	response *http.Response
+	err      error
+	cancel   context.CancelFunc
+}
+
+// cancelOnClose cancels the context of a request once its response body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (body *cancelOnClose) Close() error {
+	err := body.ReadCloser.Close()
+	body.cancel()
+	return err
+}
+
+// hedgingTransport sends the request to the primary backend and, if it did not respond within the delay, a copy to a
+// second backend. The first successful response wins and the other request is cancelled.
+type hedgingTransport struct {
+	// gateways receive the unchanged url
+	gateways map[string]bool
+	// uri is the request uri of the original request, used to determine the url of the second backend
+	uri     string
+	body    []byte
+	primary string
+	delay   time.Duration
+	// selectHedge returns the backend of the second request
+	selectHedge func() (string, error)
+
+	// served is the backend whose response or error has been returned by RoundTrip
+	served string
+	// failed contains the errors of the other backends that failed, cancelled holds the backend that lost the race
+	failed    map[string]error
+	cancelled string
+}
+
+func (t *hedgingTransport) send(responses chan<- hedgedResponse, req *http.Request, ip string, cancel context.CancelFunc) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	responses <- hedgedResponse{
+		ip:       ip,
+		response: resp,
+		err:      err,
+		cancel:   cancel,
+	}
+}
+
+// retarget returns a copy of the outgoing request that is sent to ip instead
+func (t *hedgingTransport) retarget(req *http.Request, ip string) *http.Request {
+	hedge := req.Clone(req.Context())
+	// req has been rewritten for the primary backend, so the url is built from the original request uri
+	target := functionUrl(t.uri, ip)
+	if t.gateways[ip] {
+		if original, err := url.ParseRequestURI(t.uri); err == nil {
+			target = original
+		}
+	}
+	hedge.URL.Path = target.Path
+	hedge.URL.RawPath = target.RawPath
+	hedge.URL.RawQuery = target.RawQuery
+	hedge.URL.Host = ip
+	hedge.Host = ip
+	hedge.Header.Set("X-Final-Host", ip)
+	hedge.Body = http.NoBody
+	if len(t.body) > 0 {
+		hedge.Body = io.NopCloser(bytes.NewReader(t.body))
+	}
+	return hedge
+}
+
+func (t *hedgingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.failed = make(map[string]error)
+	responses := make(chan hedgedResponse, 2)
+	cancels := make(map[string]context.CancelFunc, 2)
+	start := func(req *http.Request, ip string) {
+		ctx, cancel := context.WithCancel(req.Context())
+		cancels[ip] = cancel
+		go t.send(responses, req.WithContext(ctx), ip, cancel)
+	}
+	start(req, t.primary)
+	pending := map[string]bool{t.primary: true}
+	hedged := false
+
+	timer := time.NewTimer(t.delay)
+	defer timer.Stop()
+
+	var last hedgedResponse
+	for len(pending) > 0 {
+		select {
+		case r := <-responses:
+			delete(pending, r.ip)
+			if r.err == nil {
+				t.served = r.ip
+				r.response.Body = &cancelOnClose{r.response.Body, r.cancel}
+				for ip := range pending {
+					t.cancelled = ip
+					cancels[ip]()
+					go discard(responses)
+				}
+				return r.response, nil
+			}
+			r.cancel()
+			t.failed[r.ip] = r.err
+			last = r
+		case <-timer.C:
+			if hedged {
+				continue
+			}
+			hedged = true
+			ip, err := t.selectHedge()
+			if err != nil {
+				zap.S().Debugf("cannot hedge request: %s", err)
+				continue
+			}
+			zap.S().Debugf("hedge request to %s after %s without response from %s", ip, t.delay, t.primary)
+			pending[ip] = true
+			start(t.retarget(req, ip), ip)
+		}
+	}
+	t.served = last.ip
+	delete(t.failed, last.ip)
+	return nil, last.err
+}
+
+// discard releases the response of the request that lost the race
+func discard(responses <-chan hedgedResponse) {
+	r := <-responses
+	r.cancel()
+	if r.response != nil {
+		r.response.Body.Close()
+	}
+}
+
+// hedge proxies the request with a hedgingTransport
+func (handler *WeightedRoundRobinHandler) hedge(res http.ResponseWriter, req *http.Request, function string, r route, body []byte, policy FunctionPolicy, span *tracing.Span) {
+	ip, selected, err := handler.selectBackend(req, function, r, make(map[string]bool))
+	if err != nil {
+		writeSelectError(res, err, handler.functionState.Zone)
+		return
+	}
+
+	window := handler.latencyWindow(function)
+	delay := time.Duration(policy.HedgeDelay)
+	if policy.HedgePercentile > 0 {
+		if percentile, ok := window.percentile(policy.HedgePercentile); ok {
+			delay = percentile
+		}
+	}
+	if delay <= 0 {
+		// neither a fixed delay nor enough latencies to calculate the percentile
+		delay = time.Duration(math.MaxInt64)
+	}
+
+	// selectedBy holds whether the strategy selected the backends the request has been sent to
+	selectedBy := map[string]bool{ip: selected}
+	transport := &hedgingTransport{
+		gateways: r.gateways,
+		uri:      req.URL.RequestURI(),
+		body:     body,
+		primary:  ip,
+		delay:    delay,
+		selectHedge: func() (string, error) {
+			hedge, hedgeSelected, err := handler.selectBackend(req, function, r, map[string]bool{ip: true})
+			// selectHedge is called by the transport before forward returns
+			selectedBy[hedge] = hedgeSelected
+			return hedge, err
+		},
+	}
+	attemptSpan := startAttemptSpan(span, function, ip, 1)
+	outgoing := replay(req, body)
+	attemptSpan.Inject(outgoing.Header)
+	finished := handler.metrics.started(function, ip, r.gateways[ip])
+	result := handler.forward(res, outgoing, ip, r.gateways[ip], nil, transport)
+	finished()
+	if result.Err == nil {
+		window.observe(result.Duration)
+	}
+
+	served := transport.served
+	if served == "" {
+		served = ip
+	}
+	attemptSpan.SetAttribute("golb.backend", served)
+	attemptSpan.SetAttribute("golb.hedged", transport.cancelled != "" || len(transport.failed) > 0)
+	endAttemptSpan(attemptSpan, result)
+	span.SetAttribute("golb.backend", served)
+	span.SetAttribute("golb.attempts", 1)
+	handler.done(function, r.strategy, served, selectedBy[served], result)
+	for failed, err := range transport.failed {
+		handler.done(function, r.strategy, failed, selectedBy[failed], loadbalancer.Result{Err: err})
+	}
+	if transport.cancelled != "" {
+		handler.done(function, r.strategy, transport.cancelled, selectedBy[transport.cancelled], loadbalancer.Result{Err: loadbalancer.ErrSkipped})
+	}
+}
+
+func (handler *WeightedRoundRobinHandler) latencyWindow(function string) *latencyWindow {
+	handler.latencyMtx.Lock()
+	defer handler.latencyMtx.Unlock()
+	window, found := handler.latencies[function]
+	if !found {
+		window = &latencyWindow{}
+		handler.latencies[function] = window
+	}
+	return window
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatencyWindowPercentile(t *testing.T) {
+	tests := []struct {
+		name       string
+		latencies  int
+		percentile float64
+		expect     time.Duration
+		ok         bool
+	}{
+		{"too few samples", minLatencySamples - 1, 50, 0, false},
+		{"median", 100, 50, 50 * time.Millisecond, true},
+		{"p95", 100, 95, 95 * time.Millisecond, true},
+		{"maximum", 100, 100, 100 * time.Millisecond, true},
+		{"minimum", 100, 0, time.Millisecond, true},
+		{"only the latest window", latencyWindowSize + 100, 0, 101 * time.Millisecond, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			window := &latencyWindow{}
+			for i := 1; i <= test.latencies; i++ {
+				window.observe(time.Duration(i) * time.Millisecond)
+			}
+			latency, ok := window.percentile(test.percentile)
+			if ok != test.ok {
+				t.Fatalf("ok is %t, expected %t", ok, test.ok)
+			}
+			if latency != test.expect {
+				t.Errorf("got %s, expected %s", latency, test.expect)
+			}
+		})
+	}
+}
+
+// recordUri returns a handler that sends the request uri to uris, a slow handler only responds once the request is
+// cancelled
+func recordUri(slow bool, uris chan<- string) http.HandlerFunc {
+	return func(res http.ResponseWriter, req *http.Request) {
+		uris <- req.URL.RequestURI()
+		if slow {
+			select {
+			case <-req.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+		}
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+func TestHedgeUrls(t *testing.T) {
+	tests := []struct {
+		name           string
+		primaryGateway bool
+		hedgeGateway   bool
+		primaryUri     string
+		hedgeUri       string
+	}{
+		{"pod primary and gateway hedge", false, true, "/predict?x=1", "/function/f/predict?x=1"},
+		{"gateway primary and pod hedge", true, false, "/function/f/predict?x=1", "/predict?x=1"},
+		{"pods", false, false, "/predict?x=1", "/predict?x=1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			primaryUris := make(chan string, 1)
+			hedgeUris := make(chan string, 1)
+			primary := newTestBackend(t, recordUri(true, primaryUris))
+			hedge := newTestBackend(t, recordUri(false, hedgeUris))
+			weights := Weights{Ips: []string{primary, hedge}, Weights: []int{1, 1}, Gateways: []bool{test.primaryGateway, test.hedgeGateway}}
+			inFlight := &inFlightCounts{counts: make(map[string]int)}
+			handler := newTestHandler(newStickyFactory(inFlight), FunctionPolicy{RetryAttempts: 1, HedgeDelay: Duration(10 * time.Millisecond)},
+				map[string]Weights{"f": weights})
+
+			res := httptest.NewRecorder()
+			handler.Handle(res, httptest.NewRequest(http.MethodGet, "/function/f/predict?x=1", nil))
+			if res.Code != http.StatusOK {
+				t.Fatalf("got status %d", res.Code)
+			}
+			if uri := <-primaryUris; uri != test.primaryUri {
+				t.Errorf("primary received %s, expected %s", uri, test.primaryUri)
+			}
+			if uri := <-hedgeUris; uri != test.hedgeUri {
+				t.Errorf("hedge received %s, expected %s", uri, test.hedgeUri)
+			}
+			// the primary does not answer before it is cancelled, so the hedge serves the request
+			if served := res.Header().Get("X-Final-Host"); served != hedge {
+				t.Errorf("final host is %s, expected the hedge %s", served, hedge)
+			}
+			if route := res.Header().Get(RouteHeader); !strings.HasSuffix(route, hedge) {
+				t.Errorf("route is %s, expected it to end with the hedge %s", route, hedge)
+			}
+		})
+	}
+}
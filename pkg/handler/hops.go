@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"net/http"
+	"strings"
+)
+
+const (
+	// HopsHeader lists the load balancers a request has passed, e.g., "node-1@zone-a, node-2@zone-b"
+	HopsHeader = "X-Golb-Hops"
+	// RouteHeader shows the load balancers and the backend that served a request
+	RouteHeader = "X-Golb-Route"
+	// DefaultMaxHops allows a request to be forwarded to the gateway of one other zone
+	DefaultMaxHops = 2
+)
+
+var (
+	errLoopDetected = errors.New("routing loop detected")
+	errMaxHops      = errors.New("too many hops")
+)
+
+// hop is a load balancer that a request has passed
+type hop struct {
+	Node string
+	Zone string
+}
+
+func (h hop) String() string {
+	return fmt.Sprintf("%s@%s", h.Node, h.Zone)
+}
+
+type hopChain []hop
+
+// parseHops reads the hops of a request, entries without zone are ignored
+func parseHops(header http.Header) hopChain {
+	var chain hopChain
+	for _, value := range header.Values(HopsHeader) {
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			i := strings.LastIndex(entry, "@")
+			if i < 0 {
+				continue
+			}
+			chain = append(chain, hop{Node: entry[:i], Zone: entry[i+1:]})
+		}
+	}
+	return chain
+}
+
+func (chain hopChain) String() string {
+	entries := make([]string, len(chain))
+	for i, h := range chain {
+		entries[i] = h.String()
+	}
+	return strings.Join(entries, ", ")
+}
+
+// visited returns whether the request has already passed a load balancer of the zone
+func (chain hopChain) visited(zone string) bool {
+	for _, h := range chain {
+		if h.Zone == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// isForwarded returns true if the request was already forwarded by another load balancer
+func isForwarded(req *http.Request) bool {
+	return len(parseHops(req.Header)) > 0
+}
+
+// checkHops returns an error if the request has already passed this zone or as many load balancers as allowed
+func (f *forwarder) checkHops(chain hopChain) error {
+	if chain.visited(f.Zone) {
+		return fmt.Errorf("%w: %s has already passed zone %s", errLoopDetected, chain, f.Zone)
+	}
+	if len(chain) >= f.MaxHops {
+		return fmt.Errorf("%w: %s has reached the maximum of %d hops", errMaxHops, chain, f.MaxHops)
+	}
+	return nil
+}
+
+// addHop appends this load balancer to the hops of the request and returns the new chain
+func (f *forwarder) addHop(req *http.Request, chain hopChain) hopChain {
+	chain = append(chain, hop{Node: f.NodeName, Zone: f.Zone})
+	req.Header.Set(HopsHeader, chain.String())
+	return chain
+}
+
+// mayUseGateway returns whether a request with the given hops, including this load balancer, may be sent to a gateway
+func (f *forwarder) mayUseGateway(chain hopChain) bool {
+	return len(chain) < f.MaxHops
+}
+
+// routeOf returns the route of a request that is sent to ip
+func routeOf(req *http.Request, ip string) string {
+	if hops := req.Header.Get(HopsHeader); hops != "" {
+		return fmt.Sprintf("%s, %s", hops, ip)
+	}
+	return ip
+}
+
+func writeHopError(res http.ResponseWriter, err error, chain hopChain, zone string) {
+	text := fmt.Sprintf("error forwarding request: %s - in %s", err, zone)
+	zap.S().Info(text)
+	res.Header().Set(RouteHeader, chain.String())
+	res.WriteHeader(http.StatusLoopDetected)
+	res.Write([]byte(text))
+}
@@ -0,0 +1,198 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseHops(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		chain  hopChain
+	}{
+		{"none", nil, nil},
+		{"one", []string{"node-a@zone-a"}, hopChain{{"node-a", "zone-a"}}},
+		{"list", []string{"node-a@zone-a, node-b@zone-b"}, hopChain{{"node-a", "zone-a"}, {"node-b", "zone-b"}}},
+		{"repeated header", []string{"node-a@zone-a", "node-b@zone-b"}, hopChain{{"node-a", "zone-a"}, {"node-b", "zone-b"}}},
+		{"node with @", []string{"lb@host@zone-a"}, hopChain{{"lb@host", "zone-a"}}},
+		{"without zone", []string{"node-a, node-b@zone-b"}, hopChain{{"node-b", "zone-b"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			for _, value := range test.values {
+				header.Add(HopsHeader, value)
+			}
+			if chain := parseHops(header); !reflect.DeepEqual(chain, test.chain) {
+				t.Errorf("parsed %v, expected %v", chain, test.chain)
+			}
+		})
+	}
+}
+
+func TestCheckHops(t *testing.T) {
+	f := newForwarder("node-a", "zone-a", 2, nil)
+	tests := []struct {
+		name  string
+		chain hopChain
+		err   error
+	}{
+		{"first hop", nil, nil},
+		{"from another zone", hopChain{{"node-b", "zone-b"}}, nil},
+		{"loop", hopChain{{"node-a", "zone-a"}}, errLoopDetected},
+		{"loop through another zone", hopChain{{"node-x", "zone-a"}, {"node-b", "zone-b"}}, errLoopDetected},
+		{"max hops", hopChain{{"node-b", "zone-b"}, {"node-c", "zone-c"}}, errMaxHops},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := f.checkHops(test.chain); !errors.Is(err, test.err) {
+				t.Errorf("got error %v, expected %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestHandleHops(t *testing.T) {
+	backend := newTestBackend(t, respondWith(http.StatusOK))
+	inFlight := &inFlightCounts{counts: make(map[string]int)}
+	handler := newTestHandler(newStickyFactory(inFlight), FunctionPolicy{RetryAttempts: 1},
+		map[string]Weights{"f": {Ips: []string{backend}, Weights: []int{1}}})
+	// the test requests come from 192.0.2.1, a load balancer of another zone
+	handler.TrustedProxies, _ = parseNetworks([]string{"192.0.2.0/24"})
+
+	tests := []struct {
+		name   string
+		hops   string
+		status int
+		route  string
+	}{
+		{"from a client", "", http.StatusOK, "node-a@zone-a, " + backend},
+		{"from another zone", "node-b@zone-b", http.StatusOK, "node-b@zone-b, node-a@zone-a, " + backend},
+		{"loop", "node-a@zone-a, node-b@zone-b", http.StatusLoopDetected, "node-a@zone-a, node-b@zone-b, node-a@zone-a"},
+		{"max hops", "node-b@zone-b, node-c@zone-c", http.StatusLoopDetected, "node-b@zone-b, node-c@zone-c, node-a@zone-a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/function/f/", nil)
+			if test.hops != "" {
+				req.Header.Set(HopsHeader, test.hops)
+			}
+			res := httptest.NewRecorder()
+			handler.Handle(res, req)
+			if res.Code != test.status {
+				t.Errorf("got status %d, expected %d", res.Code, test.status)
+			}
+			if route := res.Header().Get(RouteHeader); route != test.route {
+				t.Errorf("got route '%s', expected '%s'", route, test.route)
+			}
+		})
+	}
+}
+
+func TestHandleIgnoresHopsOfUntrustedPeers(t *testing.T) {
+	received := make(chan http.Header, 1)
+	backend := newTestBackend(t, func(res http.ResponseWriter, req *http.Request) {
+		received <- req.Header.Clone()
+	})
+	inFlight := &inFlightCounts{counts: make(map[string]int)}
+	handler := newTestHandler(newStickyFactory(inFlight), FunctionPolicy{RetryAttempts: 1},
+		map[string]Weights{"f": {Ips: []string{backend}, Weights: []int{1}}})
+	handler.TrustedProxies, _ = parseNetworks([]string{"10.1.0.0/16"})
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		status     int
+		hops       string
+	}{
+		{"untrusted client", "192.0.2.1:1234", http.StatusOK, "node-a@zone-a"},
+		{"trusted proxy", "10.1.0.2:1234", http.StatusLoopDetected, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/function/f/", nil)
+			req.RemoteAddr = test.remoteAddr
+			// a loop through this zone
+			req.Header.Set(HopsHeader, "node-a@zone-a")
+			req.Header.Set(RouteHeader, "fake")
+			res := httptest.NewRecorder()
+			handler.Handle(res, req)
+			if res.Code != test.status {
+				t.Fatalf("got status %d, expected %d", res.Code, test.status)
+			}
+			if test.status != http.StatusOK {
+				return
+			}
+			header := <-received
+			if hops := header.Get(HopsHeader); hops != test.hops {
+				t.Errorf("backend received hops '%s', expected '%s'", hops, test.hops)
+			}
+			if route := header.Get(RouteHeader); route != "" {
+				t.Errorf("backend received route '%s'", route)
+			}
+		})
+	}
+}
+
+func TestUntrustedLoadBalancersDoNotLoop(t *testing.T) {
+	var handlers [2]*WeightedRoundRobinHandler
+	var requests [2]atomic.Int64
+	addresses := make([]string, 2)
+	for i := range handlers {
+		i := i
+		addresses[i] = newTestBackend(t, func(res http.ResponseWriter, req *http.Request) {
+			// stops the loop if the load balancers keep forwarding the request to each other
+			if requests[i].Add(1) > 10 {
+				res.WriteHeader(http.StatusTeapot)
+				return
+			}
+			handlers[i].Handle(res, req)
+		})
+	}
+	for i, zone := range []string{"zone-a", "zone-b"} {
+		// the only backend of each load balancer is the other one, which it does not trust
+		functionState := NewFunctionState(zone)
+		functionState.Put("f", Weights{Ips: []string{addresses[1-i]}, Weights: []int{1}, Gateways: []bool{true}})
+		matcher, _ := NewGatewayMatcher(nil, nil)
+		handlers[i] = newWeightedRoundRobinHandler(newForwarder("node-"+zone, zone, DefaultMaxHops, nil), matcher,
+			NewDefaultLocalityOptions(), functionState, newStickyFactory(&inFlightCounts{counts: make(map[string]int)}),
+			Policies{Default: FunctionPolicy{RetryAttempts: 1}}, NewDefaultRetryOptions())
+	}
+
+	resp, err := http.Get("http://" + addresses[0] + "/function/f/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, expected zone-b to have no backend but the gateway", resp.StatusCode)
+	}
+	if a, b := requests[0].Load(), requests[1].Load(); a != 1 || b != 1 {
+		t.Errorf("zone-a received %d requests and zone-b %d, expected one each", a, b)
+	}
+}
+
+func TestGatewaysAreTrusted(t *testing.T) {
+	matcher, _ := NewGatewayMatcher([]string{"192.0.2.1:8080", "gateway.example.com"}, []string{"198.51.100.0/24"})
+	f := newForwarder("node-a", "zone-a", DefaultMaxHops, matcher.peers())
+	tests := []struct {
+		remoteAddr string
+		trusted    bool
+	}{
+		{"192.0.2.1:43210", true},
+		{"198.51.100.7:43210", true},
+		{"203.0.113.1:43210", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/function/f/", nil)
+		req.RemoteAddr = test.remoteAddr
+		if trusted := f.trusted(req); trusted != test.trusted {
+			t.Errorf("%s is trusted: %t, expected %t", test.remoteAddr, trusted, test.trusted)
+		}
+	}
+}
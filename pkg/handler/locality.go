@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync/atomic"
+)
+
+type LocalityOptions struct {
+	Enabled bool `yaml:"enabled"`
+	// MinHealthyPercent is the share of the weight of the local backends that has to be available to keep all
+	// requests in the zone. Below, requests spill over to remote backends in proportion to the missing weight.
+	MinHealthyPercent int `yaml:"min_healthy_percent"`
+	// MaxInFlight is the number of concurrent requests per available local backend above which the local backends are
+	// saturated and further requests spill over to remote backends, 0 disables the limit
+	MaxInFlight int `yaml:"max_in_flight"`
+}
+
+func NewDefaultLocalityOptions() LocalityOptions {
+	return LocalityOptions{
+		Enabled:           false,
+		MinHealthyPercent: 70,
+		MaxInFlight:       0,
+	}
+}
+
+// ReadLocalityOptions overrides the options with the eb_go_lb_locality* variables of the environment
+func ReadLocalityOptions(environment env.Environment, options LocalityOptions) (LocalityOptions, error) {
+	if enabled, found, err := environment.LookupBool("eb_go_lb_locality"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_locality: %s", err)
+		}
+		options.Enabled = enabled
+	}
+	if percent, found, err := environment.LookupInt("eb_go_lb_locality_min_healthy_percent"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_locality_min_healthy_percent: %s", err)
+		}
+		options.MinHealthyPercent = int(percent)
+	}
+	if maxInFlight, found, err := environment.LookupInt("eb_go_lb_locality_max_in_flight"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_locality_max_in_flight: %s", err)
+		}
+		options.MaxInFlight = int(maxInFlight)
+	}
+	return options, nil
+}
+
+func (options LocalityOptions) Validate() error {
+	if options.MinHealthyPercent < 1 || options.MinHealthyPercent > 100 {
+		return fmt.Errorf("locality min healthy percent must be between 1 and 100")
+	}
+	if options.MaxInFlight < 0 {
+		return fmt.Errorf("locality max in flight must not be negative")
+	}
+	return nil
+}
+
+// localShare returns the share of requests that stay in the zone if healthy of the capacity of the local backends
+// are available
+func (options LocalityOptions) localShare(capacity int, healthy int) float64 {
+	if capacity <= 0 {
+		return 0
+	}
+	share := float64(healthy) * 100 / (float64(capacity) * float64(options.MinHealthyPercent))
+	return math.Min(share, 1)
+}
+
+// LocalityState is the state of a localityStrategy
+type LocalityState struct {
+	LocalShare float64     `json:"local_share"`
+	InFlight   int64       `json:"local_in_flight"`
+	Capacity   int64       `json:"local_capacity,omitempty"`
+	Local      interface{} `json:"local,omitempty"`
+	Remote     interface{} `json:"remote,omitempty"`
+}
+
+// localityStrategy sends a share of the requests to the backends of the own zone and the remaining requests to
+// remote backends, i.e., backends of other zones and gateways. Each group has its own strategy. Requests also go to
+// remote backends while the local backends are saturated, i.e., have as many requests in flight as their capacity.
+type localityStrategy struct {
+	local      loadbalancer.LoadBalancingStrategy
+	remote     loadbalancer.LoadBalancingStrategy
+	localIps   map[string]bool
+	localShare float64
+	// inFlight counts the requests of the local backends, it is shared with the strategies that replace this one
+	inFlight *atomic.Int64
+	// capacity is the number of requests the local backends may have in flight, 0 is unlimited
+	capacity int64
+}
+
+func (s *localityStrategy) Select(req *http.Request) (string, error) {
+	if rand.Float64() < s.localShare && !s.saturated() {
+		ip, err := s.local.Select(req)
+		if err == nil {
+			s.inFlight.Add(1)
+		}
+		return ip, err
+	}
+	return s.remote.Select(req)
+}
+
+func (s *localityStrategy) saturated() bool {
+	return s.capacity > 0 && s.inFlight.Load() >= s.capacity
+}
+
+func (s *localityStrategy) Done(ip string, result loadbalancer.Result) {
+	if s.localIps[ip] {
+		s.inFlight.Add(-1)
+		s.local.Done(ip, result)
+	} else {
+		s.remote.Done(ip, result)
+	}
+}
+
+func (s *localityStrategy) Inspect() interface{} {
+	state := LocalityState{LocalShare: s.localShare, InFlight: s.inFlight.Load(), Capacity: s.capacity}
+	if inspector, ok := s.local.(loadbalancer.Inspector); ok {
+		state.Local = inspector.Inspect()
+	}
+	if inspector, ok := s.remote.(loadbalancer.Inspector); ok {
+		state.Remote = inspector.Inspect()
+	}
+	return state
+}
+
+// previousStrategy returns the strategy of the local or remote backends that has been used so far
+func previousStrategy(previous loadbalancer.LoadBalancingStrategy, local bool) loadbalancer.LoadBalancingStrategy {
+	s, ok := previous.(*localityStrategy)
+	if !ok {
+		return previous
+	}
+	if local {
+		return s.local
+	}
+	return s.remote
+}
+
+// previousInFlight returns the counter of the local requests of the previous strategy, so that the requests it
+// selected are still counted
+func previousInFlight(previous loadbalancer.LoadBalancingStrategy) *atomic.Int64 {
+	if s, ok := previous.(*localityStrategy); ok {
+		return s.inFlight
+	}
+	return &atomic.Int64{}
+}
+
+// isLocal returns whether the backend at index i is in the zone of the load balancer. Backends without zone are local,
+// gateways are always remote.
+func (handler *WeightedRoundRobinHandler) isLocal(weights Weights, i int, gateways map[string]bool) bool {
+	if gateways[weights.Ips[i]] {
+		return false
+	}
+	zone := weights.ZoneOf(i)
+	return zone == "" || zone == handler.Zone
+}
+
+// newRouteStrategy creates the strategy of the available backends of a function. With locality, the local backends
+// come first in the returned weights, so that they are preferred if the strategy cannot select a backend.
+func (handler *WeightedRoundRobinHandler) newRouteStrategy(weights Weights, available Weights, gateways map[string]bool, previous loadbalancer.LoadBalancingStrategy) (loadbalancer.LoadBalancingStrategy, Weights, error) {
+	if !handler.locality.Enabled {
+		strategy, err := handler.newStrategy(available, previous)
+		return strategy, available, err
+	}
+
+	capacity := 0
+	for i := range weights.Ips {
+		if handler.isLocal(weights, i, gateways) {
+			capacity += weights.Weights[i]
+		}
+	}
+	localIps := make(map[string]bool)
+	healthy, remoteWeight := 0, 0
+	for i, ip := range available.Ips {
+		if handler.isLocal(available, i, gateways) {
+			localIps[ip] = true
+			healthy += available.Weights[i]
+		} else {
+			remoteWeight += available.Weights[i]
+		}
+	}
+	local := available.Filter(func(ip string) bool {
+		return localIps[ip]
+	})
+	remote := available.Filter(func(ip string) bool {
+		return !localIps[ip]
+	})
+	if healthy == 0 || remoteWeight == 0 {
+		strategy, err := handler.newStrategy(available, previousStrategy(previous, healthy > 0))
+		return strategy, available, err
+	}
+
+	localStrategy, err := handler.newStrategy(local, previousStrategy(previous, true))
+	if err != nil {
+		return nil, available, err
+	}
+	remoteStrategy, err := handler.newStrategy(remote, previousStrategy(previous, false))
+	if err != nil {
+		return nil, available, err
+	}
+	strategy := &localityStrategy{
+		local:      localStrategy,
+		remote:     remoteStrategy,
+		localIps:   localIps,
+		localShare: handler.locality.localShare(capacity, healthy),
+		inFlight:   previousInFlight(previous),
+		capacity:   int64(handler.locality.MaxInFlight * len(local.Ips)),
+	}
+	return strategy, local.Concat(remote), nil
+}
@@ -0,0 +1,134 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newLocalityHandler returns a handler in zone-a whose strategies always select the first backend of their group
+func newLocalityHandler(options LocalityOptions) *WeightedRoundRobinHandler {
+	handler := newTestHandler(newStickyFactory(&inFlightCounts{counts: make(map[string]int)}), FunctionPolicy{}, nil)
+	handler.locality = options
+	return handler
+}
+
+func TestLocalShare(t *testing.T) {
+	options := LocalityOptions{Enabled: true, MinHealthyPercent: 70}
+	tests := []struct {
+		name     string
+		capacity int
+		healthy  int
+		share    float64
+	}{
+		{"all available", 4, 4, 1},
+		{"above min healthy", 4, 3, 1},
+		{"half available", 4, 2, 0.5 / 0.7},
+		{"quarter available", 4, 1, 0.25 / 0.7},
+		{"none available", 4, 0, 0},
+		{"no local backends", 0, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if share := options.localShare(test.capacity, test.healthy); math.Abs(share-test.share) > 1e-9 {
+				t.Errorf("local share is %f, expected %f", share, test.share)
+			}
+		})
+	}
+}
+
+func TestLocalitySpillsOverProportionally(t *testing.T) {
+	weights := Weights{
+		Ips:     []string{"a", "b", "c", "d", "remote"},
+		Weights: []int{1, 1, 1, 1, 1},
+		Zones:   []string{"zone-a", "zone-a", "zone-a", "", "zone-b"},
+	}
+	handler := newLocalityHandler(LocalityOptions{Enabled: true, MinHealthyPercent: 70})
+	tests := []struct {
+		name      string
+		available []string
+		share     float64
+	}{
+		{"all available", []string{"a", "b", "c", "d", "remote"}, 1},
+		{"above min healthy", []string{"b", "c", "d", "remote"}, 1},
+		{"half available", []string{"c", "d", "remote"}, 0.5 / 0.7},
+		{"quarter available", []string{"d", "remote"}, 0.25 / 0.7},
+	}
+	req := httptest.NewRequest(http.MethodGet, "/function/f/", nil)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			available := weights.Filter(func(ip string) bool {
+				for _, a := range test.available {
+					if a == ip {
+						return true
+					}
+				}
+				return false
+			})
+			strategy, _, err := handler.newRouteStrategy(weights, available, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			requests, local := 10000, 0
+			for i := 0; i < requests; i++ {
+				ip, err := strategy.Select(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ip != "remote" {
+					local++
+				}
+				strategy.Done(ip, success)
+			}
+			if share := float64(local) / float64(requests); math.Abs(share-test.share) > 0.03 {
+				t.Errorf("%.3f of the requests stayed local, expected %.3f", share, test.share)
+			}
+		})
+	}
+}
+
+func TestLocalitySpillsOverWhenSaturated(t *testing.T) {
+	weights := Weights{
+		Ips:     []string{"a", "b", "remote"},
+		Weights: []int{1, 1, 1},
+		Zones:   []string{"zone-a", "zone-a", "zone-b"},
+	}
+	handler := newLocalityHandler(LocalityOptions{Enabled: true, MinHealthyPercent: 70, MaxInFlight: 2})
+	strategy, _, err := handler.newRouteStrategy(weights, weights, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/function/f/", nil)
+	selectIp := func() string {
+		ip, err := strategy.Select(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ip
+	}
+
+	// two local backends take four requests
+	for i := 0; i < 4; i++ {
+		if ip := selectIp(); ip != "a" {
+			t.Fatalf("request %d went to %s while the local backends have capacity", i, ip)
+		}
+	}
+	if ip := selectIp(); ip != "remote" {
+		t.Errorf("request went to %s while the local backends are saturated", ip)
+	}
+	strategy.Done("remote", success)
+	// a replaced strategy still counts the requests in flight
+	strategy, _, err = handler.newRouteStrategy(weights, weights, nil, strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := selectIp(); ip != "remote" {
+		t.Errorf("request went to %s after the update while the local backends are saturated", ip)
+	}
+	strategy.Done("remote", success)
+	strategy.Done("a", success)
+	if ip := selectIp(); ip != "a" {
+		t.Errorf("request went to %s after a local request completed", ip)
+	}
+}
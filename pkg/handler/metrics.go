@@ -0,0 +1,206 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Metrics collects the Prometheus metrics of the load balancer. It outlives handlers that are replaced on reload, so
+// the counters are not reset. All methods can be called on a nil *Metrics, which records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests      *prometheus.CounterVec
+	duration      *prometheus.HistogramVec
+	inFlight      *prometheus.GaugeVec
+	routed        *prometheus.CounterVec
+	weight        *prometheus.GaugeVec
+	lastUpdate    *prometheus.GaugeVec
+	watchUp       prometheus.Gauge
+	watchRestarts *prometheus.CounterVec
+	watchRevision prometheus.Gauge
+
+	// backends remembers the backends of every function, to remove the weights of backends that are gone
+	backendsMtx sync.Mutex
+	backends    map[string][]string
+}
+
+// Instrumented is implemented by components that report to Metrics
+type Instrumented interface {
+	Instrument(metrics *Metrics)
+}
+
+func NewMetrics(zone string) *Metrics {
+	labels := prometheus.Labels{"zone": zone}
+	metrics := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "golb_requests_total",
+			Help:        "Requests proxied to a backend, by status class (1xx-5xx or error for transport errors).",
+			ConstLabels: labels,
+		}, []string{"function", "backend", "status_class"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        "golb_request_duration_seconds",
+			Help:        "Latency of the requests proxied to a backend.",
+			ConstLabels: labels,
+			Buckets:     prometheus.DefBuckets,
+		}, []string{"function", "backend", "status_class"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "golb_requests_in_flight",
+			Help:        "Requests that are currently proxied to a backend, hedged requests count for the first backend.",
+			ConstLabels: labels,
+		}, []string{"function", "backend"}),
+		routed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "golb_requests_routed_total",
+			Help:        "Requests sent to a gateway of another zone or to a local backend.",
+			ConstLabels: labels,
+		}, []string{"function", "target"}),
+		weight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "golb_backend_weight",
+			Help:        "Current weight of a backend.",
+			ConstLabels: labels,
+		}, []string{"function", "backend"}),
+		lastUpdate: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        "golb_weight_update_timestamp_seconds",
+			Help:        "Unix time of the last weight update of a function.",
+			ConstLabels: labels,
+		}, []string{"function"}),
+		watchUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "golb_etcd_watch_up",
+			Help:        "1 while the etcd watch is established, 0 otherwise.",
+			ConstLabels: labels,
+		}),
+		watchRestarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        "golb_etcd_watch_restarts_total",
+			Help:        "Restarts of the etcd watch, by reason (error or compacted).",
+			ConstLabels: labels,
+		}, []string{"reason"}),
+		watchRevision: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "golb_etcd_watch_revision",
+			Help:        "etcd revision of the last weights that have been received.",
+			ConstLabels: labels,
+		}),
+		backends: make(map[string][]string),
+	}
+	metrics.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		metrics.requests,
+		metrics.duration,
+		metrics.inFlight,
+		metrics.routed,
+		metrics.weight,
+		metrics.lastUpdate,
+		metrics.watchUp,
+		metrics.watchRestarts,
+		metrics.watchRevision,
+	)
+	return metrics
+}
+
+// Handler serves the metrics in the Prometheus text format
+func (metrics *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{})
+}
+
+func statusClass(result loadbalancer.Result) string {
+	if result.Err != nil || result.StatusCode == 0 {
+		return "error"
+	}
+	return fmt.Sprintf("%dxx", result.StatusCode/100)
+}
+
+// started counts a request to a backend as in flight until the returned function is called
+func (metrics *Metrics) started(function string, ip string, gateway bool) func() {
+	if metrics == nil {
+		return func() {}
+	}
+	target := "local"
+	if gateway {
+		target = "gateway"
+	}
+	metrics.routed.WithLabelValues(function, target).Inc()
+	inFlight := metrics.inFlight.WithLabelValues(function, ip)
+	inFlight.Inc()
+	return inFlight.Dec
+}
+
+// Observe records the result of a request, backends that have been skipped are not recorded
+func (metrics *Metrics) Observe(function string, ip string, result loadbalancer.Result) {
+	if metrics == nil || errors.Is(result.Err, loadbalancer.ErrSkipped) {
+		return
+	}
+	class := statusClass(result)
+	metrics.requests.WithLabelValues(function, ip, class).Inc()
+	metrics.duration.WithLabelValues(function, ip, class).Observe(result.Duration.Seconds())
+}
+
+// observeWeightUpdate sets the weights of the function's backends and the time of the update
+func (metrics *Metrics) observeWeightUpdate(update *WeightUpdate) {
+	if metrics == nil {
+		return
+	}
+	if update.Type == Delete {
+		metrics.setWeights(update.Function, Weights{})
+		metrics.lastUpdate.DeleteLabelValues(update.Function)
+		return
+	}
+	metrics.setWeights(update.Function, update.Weights)
+	metrics.lastUpdate.WithLabelValues(update.Function).Set(float64(time.Now().UnixNano()) / 1e9)
+}
+
+// setWeights replaces the weights of the function's backends
+func (metrics *Metrics) setWeights(function string, weights Weights) {
+	if metrics == nil {
+		return
+	}
+	metrics.backendsMtx.Lock()
+	defer metrics.backendsMtx.Unlock()
+	for _, ip := range metrics.backends[function] {
+		metrics.weight.DeleteLabelValues(function, ip)
+	}
+	if len(weights.Ips) == 0 {
+		delete(metrics.backends, function)
+		return
+	}
+	metrics.backends[function] = weights.Ips
+	for i, ip := range weights.Ips {
+		metrics.weight.WithLabelValues(function, ip).Set(float64(weights.Weights[i]))
+	}
+}
+
+func (metrics *Metrics) setWatchUp(up bool) {
+	if metrics == nil {
+		return
+	}
+	if up {
+		metrics.watchUp.Set(1)
+	} else {
+		metrics.watchUp.Set(0)
+	}
+}
+
+func (metrics *Metrics) watchRestarted(compacted bool) {
+	if metrics == nil {
+		return
+	}
+	reason := "error"
+	if compacted {
+		reason = "compacted"
+	}
+	metrics.watchRestarts.WithLabelValues(reason).Inc()
+}
+
+func (metrics *Metrics) setWatchRevision(revision int64) {
+	if metrics == nil {
+		return
+	}
+	metrics.watchRevision.Set(float64(revision))
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// metricValue returns the value of the counter or gauge with the name and labels, and 0 if it has not been recorded
+func metricValue(t *testing.T, metrics *Metrics, name string, labels map[string]string) float64 {
+	families, err := metrics.registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if expected, found := labels[label.GetName()]; found && expected != label.GetValue() {
+					continue metrics
+				}
+			}
+			if metric.GetCounter() != nil {
+				return metric.GetCounter().GetValue()
+			}
+			return metric.GetGauge().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestMetricsOfRequests(t *testing.T) {
+	pod := newTestBackend(t, respondWith(http.StatusOK))
+	gateway := newTestBackend(t, respondWith(http.StatusServiceUnavailable))
+	handler := newTestHandler(newStickyFactory(&inFlightCounts{counts: make(map[string]int)}), FunctionPolicy{RetryAttempts: 1}, nil)
+	handler.gateways, _ = NewGatewayMatcher([]string{gateway}, nil)
+	metrics := NewMetrics("zone-a")
+	handler.Instrument(metrics)
+
+	tests := []struct {
+		name    string
+		backend string
+		target  string
+		class   string
+	}{
+		{"local", pod, "local", "2xx"},
+		{"gateway", gateway, "gateway", "5xx"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			handler.HandleWeightUpdate(NewWeightUpdate("f", Weights{Ips: []string{test.backend}, Weights: []int{3}}))
+			if weight := metricValue(t, metrics, "golb_backend_weight", map[string]string{"backend": test.backend}); weight != 3 {
+				t.Errorf("weight of %s is %f, expected 3", test.backend, weight)
+			}
+			for i := 0; i < 2; i++ {
+				handler.Handle(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/function/f/", nil))
+			}
+			if routed := metricValue(t, metrics, "golb_requests_routed_total", map[string]string{"function": "f", "target": test.target}); routed != 2 {
+				t.Errorf("routed %f requests to %s, expected 2", routed, test.target)
+			}
+			labels := map[string]string{"function": "f", "backend": test.backend, "status_class": test.class}
+			if requests := metricValue(t, metrics, "golb_requests_total", labels); requests != 2 {
+				t.Errorf("counted %f requests with %v, expected 2", requests, labels)
+			}
+			if inFlight := metricValue(t, metrics, "golb_requests_in_flight", map[string]string{"backend": test.backend}); inFlight != 0 {
+				t.Errorf("%f requests are still in flight", inFlight)
+			}
+		})
+	}
+
+	handler.HandleWeightUpdate(NewFunctionRemoval("f"))
+	if weight := metricValue(t, metrics, "golb_backend_weight", map[string]string{"function": "f"}); weight != 0 {
+		t.Errorf("the weight of a removed function is %f", weight)
+	}
+	if updated := metricValue(t, metrics, "golb_weight_update_timestamp_seconds", map[string]string{"function": "f"}); updated != 0 {
+		t.Errorf("the update time of a removed function is %f", updated)
+	}
+}
+
+func TestMetricsOfEtcdWatch(t *testing.T) {
+	metrics := NewMetrics("zone-a")
+	updater := NewEtcdWeightUpdater(nil)
+	updater.Instrument(metrics)
+	updates := make(chan *WeightUpdate, 1)
+
+	updater.replace(map[string]Weights{"f": {Ips: []string{"a"}, Weights: []int{1}}}, 42, updates)
+	if revision := metricValue(t, metrics, "golb_etcd_watch_revision", nil); revision != 42 {
+		t.Errorf("revision is %f, expected 42", revision)
+	}
+
+	metrics.setWatchUp(true)
+	if up := metricValue(t, metrics, "golb_etcd_watch_up", nil); up != 1 {
+		t.Errorf("watch up is %f, expected 1", up)
+	}
+	metrics.watchRestarted(true)
+	metrics.watchRestarted(false)
+	metrics.watchRestarted(false)
+	for reason, expect := range map[string]float64{"compacted": 1, "error": 2} {
+		if restarts := metricValue(t, metrics, "golb_etcd_watch_restarts_total", map[string]string{"reason": reason}); restarts != expect {
+			t.Errorf("got %f restarts because of %s, expected %f", restarts, reason, expect)
+		}
+	}
+}
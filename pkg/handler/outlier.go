@@ -0,0 +1,234 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"sync"
+	"time"
+)
+
+// ResultObserver is notified about the outcome of every proxied request. Requests that have been cancelled before a
+// response arrived, e.g., hedged requests that lost the race, are reported with loadbalancer.ErrSkipped.
+type ResultObserver interface {
+	Observe(function string, ip string, result loadbalancer.Result)
+}
+
+type OutlierDetectionOptions struct {
+	Enabled bool `yaml:"enabled"`
+	// ConsecutiveErrors is the number of 5xx responses or transport errors in a row until a backend is ejected
+	ConsecutiveErrors int `yaml:"consecutive_errors"`
+	// BaseEjectionTime is doubled with every ejection of the same backend, up to MaxEjectionTime
+	BaseEjectionTime time.Duration `yaml:"base_ejection_time"`
+	MaxEjectionTime  time.Duration `yaml:"max_ejection_time"`
+	// MaxEjectionPercent caps the share of a function's backends that can be ejected at the same time. A single backend
+	// can always be ejected.
+	MaxEjectionPercent int `yaml:"max_ejection_percent"`
+}
+
+func NewDefaultOutlierDetectionOptions() OutlierDetectionOptions {
+	return OutlierDetectionOptions{
+		Enabled:            false,
+		ConsecutiveErrors:  5,
+		BaseEjectionTime:   30 * time.Second,
+		MaxEjectionTime:    5 * time.Minute,
+		MaxEjectionPercent: 50,
+	}
+}
+
+// ReadOutlierDetectionOptions overrides the options with the eb_go_lb_outlier* variables of the environment
+func ReadOutlierDetectionOptions(environment env.Environment, options OutlierDetectionOptions) (OutlierDetectionOptions, error) {
+	if enabled, found, err := environment.LookupBool("eb_go_lb_outlier_detection"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_outlier_detection: %s", err)
+		}
+		options.Enabled = enabled
+	}
+	if errs, found, err := environment.LookupInt("eb_go_lb_outlier_consecutive_errors"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_outlier_consecutive_errors: %s", err)
+		}
+		options.ConsecutiveErrors = int(errs)
+	}
+	if ejectionTime, found, err := environment.LookupDuration("eb_go_lb_outlier_base_ejection_time"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_outlier_base_ejection_time: %s", err)
+		}
+		options.BaseEjectionTime = ejectionTime
+	}
+	if ejectionTime, found, err := environment.LookupDuration("eb_go_lb_outlier_max_ejection_time"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_outlier_max_ejection_time: %s", err)
+		}
+		options.MaxEjectionTime = ejectionTime
+	}
+	if percent, found, err := environment.LookupInt("eb_go_lb_outlier_max_ejection_percent"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_outlier_max_ejection_percent: %s", err)
+		}
+		options.MaxEjectionPercent = int(percent)
+	}
+	return options, nil
+}
+
+func (options OutlierDetectionOptions) Validate() error {
+	if options.ConsecutiveErrors < 1 {
+		return fmt.Errorf("outlier detection consecutive errors must be at least 1")
+	}
+	if options.BaseEjectionTime <= 0 || options.MaxEjectionTime < options.BaseEjectionTime {
+		return fmt.Errorf("outlier ejection times must be positive and the max must not be below the base")
+	}
+	if options.MaxEjectionPercent < 0 || options.MaxEjectionPercent > 100 {
+		return fmt.Errorf("outlier max ejection percent must be between 0 and 100")
+	}
+	return nil
+}
+
+// ejectionTime doubles the base ejection time with every previous ejection, up to the max ejection time
+func (options OutlierDetectionOptions) ejectionTime(ejections int) time.Duration {
+	ejectionTime := options.BaseEjectionTime
+	for i := 0; i < ejections; i++ {
+		if ejectionTime > options.MaxEjectionTime/2 {
+			return options.MaxEjectionTime
+		}
+		ejectionTime *= 2
+	}
+	return ejectionTime
+}
+
+type outlierBackend struct {
+	consecutiveErrors int
+	ejections         int
+	ejectedUntil      time.Time
+	returnedAt        time.Time
+}
+
+func (backend *outlierBackend) ejected(now time.Time) bool {
+	return now.Before(backend.ejectedUntil)
+}
+
+// OutlierDetector ejects backends that fail real requests, without sending any probe traffic
+type OutlierDetector struct {
+	functionState *FunctionState
+	options       OutlierDetectionOptions
+	mtx           sync.Mutex
+	// backends are tracked per function and ip
+	backends  map[string]map[string]*outlierBackend
+	listeners []func(ip string, ejected bool)
+}
+
+func NewOutlierDetector(functionState *FunctionState, options OutlierDetectionOptions) *OutlierDetector {
+	return &OutlierDetector{
+		functionState: functionState,
+		options:       options,
+		backends:      make(map[string]map[string]*outlierBackend),
+	}
+}
+
+// Subscribe registers a listener that is called whenever a backend is ejected or returns
+func (detector *OutlierDetector) Subscribe(listener func(ip string, ejected bool)) {
+	detector.mtx.Lock()
+	defer detector.mtx.Unlock()
+	detector.listeners = append(detector.listeners, listener)
+}
+
+func (detector *OutlierDetector) Available(function string, ip string) bool {
+	detector.mtx.Lock()
+	defer detector.mtx.Unlock()
+	backend, found := detector.backends[function][ip]
+	return !found || !backend.ejected(time.Now())
+}
+
+// Prune forgets the backends that are no longer part of the functions
+func (detector *OutlierDetector) Prune(functions map[string]Weights) {
+	detector.mtx.Lock()
+	defer detector.mtx.Unlock()
+	for function, backends := range detector.backends {
+		weights, found := functions[function]
+		if !found {
+			delete(detector.backends, function)
+			continue
+		}
+		ips := make(map[string]bool, len(weights.Ips))
+		for _, ip := range weights.Ips {
+			ips[ip] = true
+		}
+		for ip := range backends {
+			if !ips[ip] {
+				delete(backends, ip)
+			}
+		}
+	}
+}
+
+func (detector *OutlierDetector) backend(function string, ip string) *outlierBackend {
+	backends, found := detector.backends[function]
+	if !found {
+		backends = make(map[string]*outlierBackend)
+		detector.backends[function] = backends
+	}
+	backend, found := backends[ip]
+	if !found {
+		backend = &outlierBackend{}
+		backends[ip] = backend
+	}
+	return backend
+}
+
+func (detector *OutlierDetector) canEject(function string, now time.Time) bool {
+	ejected := 0
+	for _, backend := range detector.backends[function] {
+		if backend.ejected(now) {
+			ejected++
+		}
+	}
+	weights, _ := detector.functionState.Function(function)
+	total := len(weights.Ips)
+	return ejected == 0 || (ejected+1)*100 <= detector.options.MaxEjectionPercent*total
+}
+
+func (detector *OutlierDetector) Observe(function string, ip string, result loadbalancer.Result) {
+	if errors.Is(result.Err, loadbalancer.ErrSkipped) {
+		return
+	}
+	now := time.Now()
+	detector.mtx.Lock()
+	backend := detector.backend(function, ip)
+
+	if result.Err == nil && result.StatusCode < 500 {
+		backend.consecutiveErrors = 0
+		// forget previous ejections once the backend behaved for the longest possible ejection time
+		if backend.ejections > 0 && !backend.ejected(now) && now.Sub(backend.returnedAt) > detector.options.MaxEjectionTime {
+			backend.ejections = 0
+		}
+		detector.mtx.Unlock()
+		return
+	}
+
+	backend.consecutiveErrors++
+	if backend.ejected(now) || backend.consecutiveErrors < detector.options.ConsecutiveErrors || !detector.canEject(function, now) {
+		detector.mtx.Unlock()
+		return
+	}
+
+	ejectionTime := detector.options.ejectionTime(backend.ejections)
+	backend.ejections++
+	backend.consecutiveErrors = 0
+	backend.ejectedUntil = now.Add(ejectionTime)
+	backend.returnedAt = backend.ejectedUntil
+	listeners := detector.listeners
+	detector.mtx.Unlock()
+
+	zap.S().Infof("eject backend %s of function %s for %s", ip, function, ejectionTime)
+	for _, listener := range listeners {
+		listener(ip, true)
+	}
+	time.AfterFunc(ejectionTime, func() {
+		zap.S().Infof("backend %s of function %s returns from ejection", ip, function)
+		for _, listener := range listeners {
+			listener(ip, false)
+		}
+	})
+}
@@ -0,0 +1,114 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestOutlierEjectionTime(t *testing.T) {
+	options := OutlierDetectionOptions{BaseEjectionTime: 30 * time.Second, MaxEjectionTime: 5 * time.Minute}
+	long := OutlierDetectionOptions{BaseEjectionTime: time.Second, MaxEjectionTime: time.Duration(math.MaxInt64)}
+	tests := []struct {
+		name      string
+		options   OutlierDetectionOptions
+		ejections int
+		expect    time.Duration
+	}{
+		{"first ejection", options, 0, 30 * time.Second},
+		{"doubled", options, 1, time.Minute},
+		{"doubled twice", options, 2, 2 * time.Minute},
+		{"capped", options, 4, 5 * time.Minute},
+		{"many ejections", options, 64, 5 * time.Minute},
+		{"more ejections than bits", options, 1000, 5 * time.Minute},
+		{"no overflow below a huge max", long, 70, long.MaxEjectionTime},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if ejectionTime := test.options.ejectionTime(test.ejections); ejectionTime != test.expect {
+				t.Errorf("got %s, expected %s", ejectionTime, test.expect)
+			}
+		})
+	}
+}
+
+var (
+	success = loadbalancer.Result{StatusCode: 200}
+	failure = loadbalancer.Result{StatusCode: 503}
+	refused = loadbalancer.Result{Err: errors.New("connection refused")}
+	skipped = loadbalancer.Result{Err: loadbalancer.ErrSkipped}
+)
+
+func newTestOutlierDetector(ips ...string) *OutlierDetector {
+	functionState := NewFunctionState("zone-a")
+	weights := Weights{Ips: ips, Weights: make([]int, len(ips))}
+	functionState.Put("f", weights)
+	options := NewDefaultOutlierDetectionOptions()
+	options.ConsecutiveErrors = 3
+	return NewOutlierDetector(functionState, options)
+}
+
+func TestOutlierDetection(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []loadbalancer.Result
+		ejected bool
+	}{
+		{"consecutive errors", []loadbalancer.Result{failure, refused, failure}, true},
+		{"too few errors", []loadbalancer.Result{failure, failure}, false},
+		{"success resets", []loadbalancer.Result{failure, failure, success, failure}, false},
+		{"skipped is ignored", []loadbalancer.Result{failure, skipped, failure, skipped, failure}, true},
+		{"client errors are successes", []loadbalancer.Result{{StatusCode: 404}, {StatusCode: 429}, {StatusCode: 400}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			detector := newTestOutlierDetector("a", "b")
+			for _, result := range test.results {
+				detector.Observe("f", "a", result)
+			}
+			if ejected := !detector.Available("f", "a"); ejected != test.ejected {
+				t.Errorf("ejected is %t, expected %t", ejected, test.ejected)
+			}
+			if !detector.Available("f", "b") {
+				t.Error("b must not be ejected")
+			}
+		})
+	}
+}
+
+func TestOutlierMaxEjectionPercent(t *testing.T) {
+	detector := newTestOutlierDetector("a", "b", "c", "d")
+	for _, ip := range []string{"a", "b", "c"} {
+		for i := 0; i < 3; i++ {
+			detector.Observe("f", ip, failure)
+		}
+	}
+	ejected := 0
+	for _, ip := range []string{"a", "b", "c", "d"} {
+		if !detector.Available("f", ip) {
+			ejected++
+		}
+	}
+	if ejected != 2 {
+		t.Errorf("expected 50%% of the backends to be ejected, got %d of 4", ejected)
+	}
+}
+
+func TestOutlierPrune(t *testing.T) {
+	detector := newTestOutlierDetector("a", "b")
+	detector.Observe("f", "a", failure)
+	detector.Observe("f", "b", failure)
+	detector.Observe("g", "a", failure)
+	detector.Prune(map[string]Weights{"f": {Ips: []string{"b"}, Weights: []int{1}}})
+	if _, found := detector.backends["g"]; found {
+		t.Error("removed function is still tracked")
+	}
+	if _, found := detector.backends["f"]["a"]; found {
+		t.Error("removed backend is still tracked")
+	}
+	if _, found := detector.backends["f"]["b"]; !found {
+		t.Error("remaining backend is no longer tracked")
+	}
+}
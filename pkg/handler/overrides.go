@@ -0,0 +1,237 @@
+package handler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type OverrideType string
+
+const (
+	// Drain removes a backend from load balancing
+	Drain OverrideType = "drain"
+	// Pin sends all requests of a function to a single backend
+	Pin OverrideType = "pin"
+	// SetWeights replaces the weights of a function
+	SetWeights OverrideType = "weights"
+)
+
+// Override is a temporary change of the routing by an operator. It takes precedence over the weights of the
+// WeightUpdater until it expires.
+type Override struct {
+	ID   string       `json:"id"`
+	Type OverrideType `json:"type"`
+	// Function is the function whose routing is changed. Drains without function apply to all functions.
+	Function string `json:"function,omitempty"`
+	// Ip is the backend that is drained or pinned
+	Ip      string    `json:"ip,omitempty"`
+	Weights *Weights  `json:"weights,omitempty"`
+	Expires time.Time `json:"expires"`
+}
+
+func (override Override) Validate() error {
+	switch override.Type {
+	case Drain:
+		if override.Ip == "" {
+			return fmt.Errorf("drain requires an ip")
+		}
+	case Pin:
+		if override.Function == "" || override.Ip == "" {
+			return fmt.Errorf("pin requires a function and an ip")
+		}
+	case SetWeights:
+		if override.Function == "" || override.Weights == nil {
+			return fmt.Errorf("weights requires a function and weights")
+		}
+		if err := validateWeights(*override.Weights); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown override type '%s', expected %s, %s or %s", override.Type, Drain, Pin, SetWeights)
+	}
+	return nil
+}
+
+// replaces returns whether both overrides change the same thing, so that the newer one replaces the older one
+func (override Override) replaces(other Override) bool {
+	if override.Type != other.Type || override.Function != other.Function {
+		return false
+	}
+	return override.Type != Drain || override.Ip == other.Ip
+}
+
+func (override Override) expired(now time.Time) bool {
+	return !now.Before(override.Expires)
+}
+
+// Overrides holds the overrides of operators. They are kept in memory only and outlive handlers that are replaced on
+// reload.
+type Overrides struct {
+	mtx          sync.Mutex
+	nextID       int
+	overrides    map[string]Override
+	timers       map[string]*time.Timer
+	nextListener int
+	listeners    map[int]func(function string)
+}
+
+func NewOverrides() *Overrides {
+	return &Overrides{
+		nextID:    1,
+		overrides: make(map[string]Override),
+		timers:    make(map[string]*time.Timer),
+		listeners: make(map[int]func(function string)),
+	}
+}
+
+// Subscribe registers a listener that is called with the function whose overrides changed, or with an empty function
+// if all functions are affected. The returned function removes the listener.
+func (overrides *Overrides) Subscribe(listener func(function string)) func() {
+	overrides.mtx.Lock()
+	defer overrides.mtx.Unlock()
+	id := overrides.nextListener
+	overrides.nextListener++
+	overrides.listeners[id] = listener
+	return func() {
+		overrides.mtx.Lock()
+		defer overrides.mtx.Unlock()
+		delete(overrides.listeners, id)
+	}
+}
+
+func (overrides *Overrides) notify(function string) {
+	overrides.mtx.Lock()
+	listeners := make([]func(string), 0, len(overrides.listeners))
+	for _, listener := range overrides.listeners {
+		listeners = append(listeners, listener)
+	}
+	overrides.mtx.Unlock()
+	for _, listener := range listeners {
+		listener(function)
+	}
+}
+
+// Add validates the override, replaces an override that changes the same thing and removes the override once it
+// expires. The returned override has its ID set.
+func (overrides *Overrides) Add(override Override) (Override, error) {
+	if err := override.Validate(); err != nil {
+		return override, err
+	}
+	overrides.mtx.Lock()
+	for id, other := range overrides.overrides {
+		if override.replaces(other) {
+			overrides.remove(id)
+		}
+	}
+	override.ID = strconv.Itoa(overrides.nextID)
+	overrides.nextID++
+	overrides.overrides[override.ID] = override
+	overrides.timers[override.ID] = time.AfterFunc(time.Until(override.Expires), func() {
+		overrides.Remove(override.ID)
+	})
+	overrides.mtx.Unlock()
+
+	overrides.notify(override.Function)
+	return override, nil
+}
+
+// Remove deletes the override with the given id and returns whether it existed
+func (overrides *Overrides) Remove(id string) bool {
+	overrides.mtx.Lock()
+	override, found := overrides.overrides[id]
+	if found {
+		overrides.remove(id)
+	}
+	overrides.mtx.Unlock()
+
+	if found {
+		overrides.notify(override.Function)
+	}
+	return found
+}
+
+func (overrides *Overrides) remove(id string) {
+	delete(overrides.overrides, id)
+	if timer, found := overrides.timers[id]; found {
+		timer.Stop()
+		delete(overrides.timers, id)
+	}
+}
+
+// List returns the overrides in the order they have been added
+func (overrides *Overrides) List() []Override {
+	overrides.mtx.Lock()
+	defer overrides.mtx.Unlock()
+	list := make([]Override, 0, len(overrides.overrides))
+	for _, override := range overrides.overrides {
+		list = append(list, override)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, _ := strconv.Atoi(list[i].ID)
+		b, _ := strconv.Atoi(list[j].ID)
+		return a < b
+	})
+	return list
+}
+
+// Apply returns the weights of the function after applying the overrides: the weights are replaced first, then the
+// function is pinned and finally drained backends are removed
+func (overrides *Overrides) Apply(function string, weights Weights) Weights {
+	if overrides == nil {
+		return weights
+	}
+	overrides.mtx.Lock()
+	defer overrides.mtx.Unlock()
+	if len(overrides.overrides) == 0 {
+		return weights
+	}
+
+	now := time.Now()
+	var pin, set *Override
+	drained := make(map[string]bool)
+	for _, override := range overrides.overrides {
+		if override.expired(now) {
+			continue
+		}
+		override := override
+		switch {
+		case override.Type == Drain && (override.Function == "" || override.Function == function):
+			drained[override.Ip] = true
+		case override.Type == Pin && override.Function == function:
+			pin = &override
+		case override.Type == SetWeights && override.Function == function:
+			set = &override
+		}
+	}
+
+	if set != nil {
+		weights = *set.Weights
+	}
+	if pin != nil {
+		weights = Weights{Ips: []string{pin.Ip}, Weights: []int{1}}
+	}
+	if len(drained) > 0 {
+		weights = weights.Filter(func(ip string) bool {
+			return !drained[ip]
+		})
+	}
+	return weights
+}
+
+// Overridable is implemented by handlers that apply Overrides
+type Overridable interface {
+	Override(overrides *Overrides)
+}
+
+// Override applies the overrides to the routes and keeps them up to date until the handler is closed
+func (handler *WeightedRoundRobinHandler) Override(overrides *Overrides) {
+	unsubscribe := overrides.Subscribe(handler.RefreshFunction)
+	handler.updateMtx.Lock()
+	handler.overrides = overrides
+	handler.closers = append(handler.closers, unsubscribe)
+	handler.updateMtx.Unlock()
+	handler.RefreshFunction("")
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOverridesApply(t *testing.T) {
+	future := time.Now().Add(time.Hour)
+	weights := Weights{Ips: []string{"a", "b", "c"}, Weights: []int{1, 2, 3}}
+	tests := []struct {
+		name      string
+		overrides []Override
+		expect    Weights
+	}{
+		{"none", nil, weights},
+		{"drain", []Override{{Type: Drain, Ip: "b"}}, Weights{Ips: []string{"a", "c"}, Weights: []int{1, 3}}},
+		{"drain of the function", []Override{{Type: Drain, Function: "f", Ip: "b"}}, Weights{Ips: []string{"a", "c"}, Weights: []int{1, 3}}},
+		{"drain of another function", []Override{{Type: Drain, Function: "g", Ip: "b"}}, weights},
+		{"pin", []Override{{Type: Pin, Function: "f", Ip: "c"}}, Weights{Ips: []string{"c"}, Weights: []int{1}}},
+		{"pin of another function", []Override{{Type: Pin, Function: "g", Ip: "c"}}, weights},
+		{"weights", []Override{{Type: SetWeights, Function: "f", Weights: &Weights{Ips: []string{"a"}, Weights: []int{5}}}}, Weights{Ips: []string{"a"}, Weights: []int{5}}},
+		{"drain after weights", []Override{
+			{Type: SetWeights, Function: "f", Weights: &Weights{Ips: []string{"a", "b"}, Weights: []int{5, 5}}},
+			{Type: Drain, Ip: "a"},
+		}, Weights{Ips: []string{"b"}, Weights: []int{5}}},
+		{"drained pin", []Override{{Type: Pin, Function: "f", Ip: "c"}, {Type: Drain, Ip: "c"}}, Weights{Ips: []string{}, Weights: []int{}}},
+		{"expired", []Override{{Type: Drain, Ip: "b", Expires: time.Now().Add(-time.Second)}}, weights},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			overrides := NewOverrides()
+			for i, override := range test.overrides {
+				if override.Expires.IsZero() {
+					override.Expires = future
+				}
+				// added directly, so that expired overrides are not removed before they are applied
+				overrides.overrides[string(rune('a'+i))] = override
+			}
+			if applied := overrides.Apply("f", weights); !reflect.DeepEqual(applied, test.expect) {
+				t.Errorf("applied %v, expected %v", applied, test.expect)
+			}
+		})
+	}
+
+	var none *Overrides
+	if applied := none.Apply("f", weights); !reflect.DeepEqual(applied, weights) {
+		t.Errorf("nil overrides changed the weights to %v", applied)
+	}
+}
+
+func TestOverridesExpire(t *testing.T) {
+	overrides := NewOverrides()
+	changed := make(chan string, 2)
+	overrides.Subscribe(func(function string) {
+		changed <- function
+	})
+	override, err := overrides.Add(Override{Type: Pin, Function: "f", Ip: "a", Expires: time.Now().Add(20 * time.Millisecond)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if function := <-changed; function != "f" {
+		t.Errorf("listener got %s on add, expected f", function)
+	}
+	if list := overrides.List(); len(list) != 1 || list[0].ID != override.ID {
+		t.Fatalf("overrides are %v, expected the pin", list)
+	}
+	select {
+	case function := <-changed:
+		if function != "f" {
+			t.Errorf("listener got %s on expiry, expected f", function)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("override did not expire")
+	}
+	if list := overrides.List(); len(list) != 0 {
+		t.Errorf("overrides are %v after the expiry", list)
+	}
+}
+
+func TestOverridesReplace(t *testing.T) {
+	overrides := NewOverrides()
+	expires := time.Now().Add(time.Hour)
+	for _, override := range []Override{
+		{Type: Pin, Function: "f", Ip: "a"},
+		{Type: Pin, Function: "f", Ip: "b"},
+		{Type: Drain, Ip: "a"},
+		{Type: Drain, Ip: "b"},
+		{Type: Drain, Ip: "b"},
+	} {
+		override.Expires = expires
+		if _, err := overrides.Add(override); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var described []string
+	for _, override := range overrides.List() {
+		described = append(described, string(override.Type)+" "+override.Ip)
+	}
+	if expect := []string{"pin b", "drain a", "drain b"}; !reflect.DeepEqual(described, expect) {
+		t.Errorf("overrides are %v, expected %v", described, expect)
+	}
+}
+
+func TestOverrideValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		override Override
+		valid    bool
+	}{
+		{"drain", Override{Type: Drain, Ip: "a"}, true},
+		{"drain without ip", Override{Type: Drain}, false},
+		{"pin", Override{Type: Pin, Function: "f", Ip: "a"}, true},
+		{"pin without function", Override{Type: Pin, Ip: "a"}, false},
+		{"weights", Override{Type: SetWeights, Function: "f", Weights: &Weights{Ips: []string{"a"}, Weights: []int{1}}}, true},
+		{"weights without weights", Override{Type: SetWeights, Function: "f"}, false},
+		{"invalid weights", Override{Type: SetWeights, Function: "f", Weights: &Weights{Ips: []string{"a"}, Weights: []int{-1}}}, false},
+		{"unknown type", Override{Type: "block", Ip: "a"}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.override.Validate(); (err == nil) != test.valid {
+				t.Errorf("got error %v, expected valid %t", err, test.valid)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"encoding/json"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"time"
+)
+
+// FunctionPolicy controls how requests of a function are proxied
+type FunctionPolicy struct {
+	// RetryAttempts is the maximum number of backends a request is sent to, 1 disables retries
+	RetryAttempts int `json:"retry_attempts" yaml:"retry_attempts"`
+	// RetryNonIdempotent allows to replay requests with methods like POST, i.e., marks them as safe to retry
+	RetryNonIdempotent bool `json:"retry_non_idempotent" yaml:"retry_non_idempotent"`
+	// HedgeDelay enables hedging, i.e., after this delay without response a second copy of the request is sent to
+	// another backend. Hedged requests are not retried.
+	HedgeDelay Duration `json:"hedge_delay" yaml:"hedge_delay"`
+	// HedgePercentile enables hedging with the given percentile (e.g., 95) of the recently observed latencies of the
+	// function as delay. HedgeDelay is used until enough latencies have been observed.
+	HedgePercentile float64 `json:"hedge_percentile" yaml:"hedge_percentile"`
+}
+
+// Duration is a time.Duration that is read from strings like "50ms" in JSON and YAML
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(v)
+	case string:
+		parsed, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration: %s", string(b))
+	}
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var duration time.Duration
+	if err := unmarshal(&duration); err != nil {
+		return err
+	}
+	*d = Duration(duration)
+	return nil
+}
+
+// hedging returns true if requests of the function may be hedged
+func (policy FunctionPolicy) hedging() bool {
+	return policy.HedgeDelay > 0 || policy.HedgePercentile > 0
+}
+
+type Policies struct {
+	Default   FunctionPolicy            `yaml:"default"`
+	Functions map[string]FunctionPolicy `yaml:"functions"`
+}
+
+// UnmarshalYAML takes the fields that are missing in the policy of a function from the default policy
+func (policies *Policies) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	raw := struct {
+		Default   FunctionPolicy           `yaml:"default"`
+		Functions map[string]yaml.MapSlice `yaml:"functions"`
+	}{Default: policies.Default}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	policies.Default = raw.Default
+	if policies.Functions == nil {
+		policies.Functions = make(map[string]FunctionPolicy)
+	}
+	for function, fields := range raw.Functions {
+		data, err := yaml.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		policy := policies.Default
+		if err := yaml.UnmarshalStrict(data, &policy); err != nil {
+			return fmt.Errorf("policy of %s: %s", function, err)
+		}
+		policies.Functions[function] = policy
+	}
+	return nil
+}
+
+func NewDefaultFunctionPolicy() FunctionPolicy {
+	return FunctionPolicy{
+		RetryAttempts:      1,
+		RetryNonIdempotent: false,
+	}
+}
+
+// For returns the policy of the function, or the default policy if the function has none
+func (policies Policies) For(function string) FunctionPolicy {
+	if policy, found := policies.Functions[function]; found {
+		return policy
+	}
+	return policies.Default
+}
+
+// ReadPolicies overrides the default policy with single variables and sets the policies of functions from
+// eb_go_lb_function_policies, a JSON object keyed by function, e.g., '{"resnet": {"retry_attempts": 3}}'. Fields that
+// are missing in a function's policy are taken from the default policy.
+func ReadPolicies(environment env.Environment, policies Policies) (Policies, error) {
+	if policies.Functions == nil {
+		policies.Functions = make(map[string]FunctionPolicy)
+	}
+
+	if attempts, found, err := environment.LookupInt("eb_go_lb_retry_attempts"); found {
+		if err != nil {
+			return policies, fmt.Errorf("eb_go_lb_retry_attempts: %s", err)
+		}
+		policies.Default.RetryAttempts = int(attempts)
+	}
+	if nonIdempotent, found, err := environment.LookupBool("eb_go_lb_retry_non_idempotent"); found {
+		if err != nil {
+			return policies, fmt.Errorf("eb_go_lb_retry_non_idempotent: %s", err)
+		}
+		policies.Default.RetryNonIdempotent = nonIdempotent
+	}
+
+	if value, found := environment.Lookup("eb_go_lb_function_policies"); found {
+		raw := make(map[string]json.RawMessage)
+		if err := json.Unmarshal([]byte(value), &raw); err != nil {
+			return policies, fmt.Errorf("eb_go_lb_function_policies: %s", err)
+		}
+		for function, message := range raw {
+			policy := policies.Default
+			if err := json.Unmarshal(message, &policy); err != nil {
+				return policies, fmt.Errorf("eb_go_lb_function_policies: policy of %s: %s", function, err)
+			}
+			policies.Functions[function] = policy
+		}
+	}
+	return policies, nil
+}
+
+func (policies Policies) Validate() error {
+	if err := policies.Default.validate(); err != nil {
+		return fmt.Errorf("default policy: %s", err)
+	}
+	for function, policy := range policies.Functions {
+		if err := policy.validate(); err != nil {
+			return fmt.Errorf("policy of %s: %s", function, err)
+		}
+	}
+	return nil
+}
+
+func (policy FunctionPolicy) validate() error {
+	if policy.RetryAttempts < 1 {
+		return fmt.Errorf("retry attempts must be at least 1, got %d", policy.RetryAttempts)
+	}
+	if policy.HedgeDelay < 0 {
+		return fmt.Errorf("hedge delay must not be negative, got %s", time.Duration(policy.HedgeDelay))
+	}
+	if policy.HedgePercentile < 0 || policy.HedgePercentile >= 100 {
+		return fmt.Errorf("hedge percentile must be between 0 and 100, got %f", policy.HedgePercentile)
+	}
+	return nil
+}
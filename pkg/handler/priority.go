@@ -0,0 +1,46 @@
+package handler
+
+import "sort"
+
+// selectTier returns the backends of the highest priority, i.e., the lowest number, that has available capacity.
+// weights are all backends of the function, available the ones that may be used. Backends of lower priorities are only
+// used if no backend of a higher priority is available. lower are the available backends of the lower priorities,
+// ordered by priority, which take requests that no backend of the tier admits.
+func selectTier(weights Weights, available Weights) (Weights, Weights, Weights) {
+	lower := Weights{Ips: []string{}, Weights: []int{}}
+	if len(weights.Priorities) == 0 {
+		return weights, available, lower
+	}
+	tier, found := 0, false
+	for i := range available.Ips {
+		if available.Weights[i] > 0 && (!found || available.PriorityOf(i) < tier) {
+			tier, found = available.PriorityOf(i), true
+		}
+	}
+	if !found {
+		return weights, available, lower
+	}
+
+	priorities := make(map[string]int, len(weights.Ips))
+	for i, ip := range weights.Ips {
+		priorities[ip] = weights.PriorityOf(i)
+	}
+	var lowerTiers []int
+	seen := make(map[int]bool)
+	for i := range available.Ips {
+		if priority := available.PriorityOf(i); priority > tier && available.Weights[i] > 0 && !seen[priority] {
+			lowerTiers = append(lowerTiers, priority)
+			seen[priority] = true
+		}
+	}
+	sort.Ints(lowerTiers)
+	for _, priority := range lowerTiers {
+		lower = lower.Concat(available.Filter(func(ip string) bool {
+			return priorities[ip] == priority
+		}))
+	}
+	inTier := func(ip string) bool {
+		return priorities[ip] == tier
+	}
+	return weights.Filter(inTier), available.Filter(inTier), lower
+}
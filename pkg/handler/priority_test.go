@@ -0,0 +1,91 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSelectTier(t *testing.T) {
+	weights := Weights{
+		Ips:        []string{"gateway", "a", "b", "c"},
+		Weights:    []int{1, 1, 1, 1},
+		Priorities: []int{2, 0, 0, 1},
+	}
+	tests := []struct {
+		name      string
+		available []string
+		weights   []int
+		tier      []string
+		fallback  []string
+	}{
+		{"highest priority", []string{"gateway", "a", "b", "c"}, nil, []string{"a", "b"}, []string{"c", "gateway"}},
+		{"partially available", []string{"gateway", "b", "c"}, nil, []string{"a", "b"}, []string{"c", "gateway"}},
+		{"failover", []string{"gateway", "c"}, nil, []string{"c"}, []string{"gateway"}},
+		{"last tier", []string{"gateway"}, nil, []string{"gateway"}, []string{}},
+		{"drained tier", []string{"gateway", "a", "b", "c"}, []int{1, 0, 0, 1}, []string{"c"}, []string{"gateway"}},
+		{"nothing available", []string{}, nil, []string{"gateway", "a", "b", "c"}, []string{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := weights
+			if test.weights != nil {
+				w.Weights = test.weights
+			}
+			available := w.Filter(func(ip string) bool {
+				for _, a := range test.available {
+					if a == ip {
+						return true
+					}
+				}
+				return false
+			})
+			tier, _, fallback := selectTier(w, available)
+			if !reflect.DeepEqual(tier.Ips, test.tier) {
+				t.Errorf("selected tier %v, expected %v", tier.Ips, test.tier)
+			}
+			if !reflect.DeepEqual(fallback.Ips, test.fallback) {
+				t.Errorf("fallback is %v, expected %v", fallback.Ips, test.fallback)
+			}
+		})
+	}
+
+	if tier, available, fallback := selectTier(Weights{Ips: []string{"a"}, Weights: []int{1}}, Weights{Ips: []string{"a"}, Weights: []int{1}}); len(tier.Ips) != 1 || len(available.Ips) != 1 || len(fallback.Ips) != 0 {
+		t.Errorf("weights without priorities are split into %v, %v and %v", tier, available, fallback)
+	}
+}
+
+func TestPriorityFallsThroughIfNoBackendAdmits(t *testing.T) {
+	primary := newTestBackend(t, respondWith(http.StatusOK))
+	secondary := newTestBackend(t, respondWith(http.StatusOK))
+	inFlight := &inFlightCounts{counts: make(map[string]int)}
+	handler := newTestHandler(newStickyFactory(inFlight), FunctionPolicy{RetryAttempts: 1},
+		map[string]Weights{"f": {Ips: []string{primary, secondary}, Weights: []int{1, 1}, Priorities: []int{0, 1}}})
+	cb, states := newTestCircuitBreaker()
+	handler.AddBackendFilter(cb)
+	handler.AddBackendAdmitter(cb)
+
+	for i := 0; i < 4; i++ {
+		cb.Observe("f", primary, failure)
+	}
+	expectState(t, states, Open)
+	expectState(t, states, HalfOpen)
+	handler.RefreshFunction("f")
+	// the half-open primary stays the selected tier, but all of its probes are in flight
+	for i := 0; i < 2; i++ {
+		if !cb.Admit("f", primary) {
+			t.Fatal("probe has not been admitted")
+		}
+	}
+
+	res := httptest.NewRecorder()
+	handler.Handle(res, httptest.NewRequest(http.MethodGet, "/function/f/", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, expected the request to fall through to the secondary", res.Code)
+	}
+	if route := res.Header().Get(RouteHeader); !strings.HasSuffix(route, secondary) {
+		t.Errorf("request took route %s, expected the secondary %s", route, secondary)
+	}
+}
@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"reflect"
+	"sync"
+)
+
+// component is a filter, observer or admitter that keeps state per backend, e.g., a health checker. A handler that
+// replaces another one on a reload takes over the components whose options did not change, so the backends keep their
+// state. The component is stopped once the last handler that uses it is closed.
+type component struct {
+	options  interface{}
+	instance interface{}
+	stop     func()
+
+	mtx      sync.Mutex
+	handlers []*WeightedRoundRobinHandler
+}
+
+// newComponent creates a component of the instance, stop may be nil
+func newComponent(options interface{}, instance interface{}, stop func()) *component {
+	return &component{
+		options:  options,
+		instance: instance,
+		stop:     stop,
+	}
+}
+
+// refreshBackend rebuilds the routes of all handlers that use the component
+func (c *component) refreshBackend(ip string) {
+	c.mtx.Lock()
+	handlers := make([]*WeightedRoundRobinHandler, len(c.handlers))
+	copy(handlers, c.handlers)
+	c.mtx.Unlock()
+	for _, handler := range handlers {
+		handler.RefreshBackend(ip)
+	}
+}
+
+// release removes the handler from the users of the component and stops it if no handler is left
+func (c *component) release(handler *WeightedRoundRobinHandler) {
+	c.mtx.Lock()
+	for i, h := range c.handlers {
+		if h == handler {
+			c.handlers = append(c.handlers[:i], c.handlers[i+1:]...)
+			break
+		}
+	}
+	unused := len(c.handlers) == 0
+	c.mtx.Unlock()
+	if unused && c.stop != nil {
+		c.stop()
+	}
+}
+
+// use registers the component as filter, observer, admitter and pruner, depending on the interfaces it implements
+func (handler *WeightedRoundRobinHandler) use(c *component) {
+	c.mtx.Lock()
+	c.handlers = append(c.handlers, handler)
+	c.mtx.Unlock()
+
+	if filter, ok := c.instance.(BackendFilter); ok {
+		handler.AddBackendFilter(filter)
+	}
+	if observer, ok := c.instance.(ResultObserver); ok {
+		handler.AddResultObserver(observer)
+	}
+	if admitter, ok := c.instance.(BackendAdmitter); ok {
+		handler.AddBackendAdmitter(admitter)
+	}
+	if pruner, ok := c.instance.(BackendPruner); ok {
+		handler.AddBackendPruner(pruner)
+	}
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	handler.components = append(handler.components, c)
+	handler.closers = append(handler.closers, func() {
+		c.release(handler)
+	})
+}
+
+// component returns the component of the handler that has been created with the options, or nil. handler may be nil.
+func (handler *WeightedRoundRobinHandler) component(options interface{}) *component {
+	if handler == nil {
+		return nil
+	}
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	for _, c := range handler.components {
+		if reflect.DeepEqual(c.options, options) {
+			return c
+		}
+	}
+	return nil
+}
+
+// takeOver continues with the state of the previous handler: with its strategies if the strategy did not change, with
+// its retry budget if the retry options did not change, and with the observed latencies
+func (handler *WeightedRoundRobinHandler) takeOver(previous *WeightedRoundRobinHandler) {
+	previous.latencyMtx.Lock()
+	handler.latencyMtx.Lock()
+	for function, window := range previous.latencies {
+		handler.latencies[function] = window
+	}
+	handler.latencyMtx.Unlock()
+	previous.latencyMtx.Unlock()
+
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	if reflect.DeepEqual(previous.options.Retry, handler.options.Retry) {
+		handler.retryBudget = previous.retryBudget
+	}
+	if previous.options.Type != handler.options.Type || !reflect.DeepEqual(previous.options.Strategy, handler.options.Strategy) {
+		return
+	}
+	previousTable := previous.table.Load()
+	table := &routingTable{
+		functions:            handler.table.Load().functions,
+		routes:               make(map[string]route),
+		routesWithoutGateway: make(map[string]route),
+	}
+	for function, weights := range table.functions {
+		// the routes of the previous handler pass their strategies on to the new routes
+		if r, found := previousTable.routes[function]; found {
+			table.routes[function] = r
+		}
+		if r, found := previousTable.routesWithoutGateway[function]; found {
+			table.routesWithoutGateway[function] = r
+		}
+		handler.updateRoutes(table, function, weights)
+	}
+	handler.table.Store(table)
+}
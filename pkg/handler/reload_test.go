@@ -0,0 +1,141 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newReloadOptions() Options {
+	options := NewDefaultOptions()
+	options.Type = "wrr"
+	options.OutlierDetection.Enabled = true
+	options.OutlierDetection.ConsecutiveErrors = 3
+	options.CircuitBreaker.Enabled = true
+	return options
+}
+
+func newReloadedHandler(t *testing.T, functionState *FunctionState, options Options, previous Handler) *WeightedRoundRobinHandler {
+	h, err := NewHandlerFromPrevious(functionState, options, previous)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		h.(*WeightedRoundRobinHandler).Close()
+	})
+	return h.(*WeightedRoundRobinHandler)
+}
+
+func availableIps(handler *WeightedRoundRobinHandler, function string) []string {
+	return handler.table.Load().routes[function].available.Ips
+}
+
+func TestReloadKeepsBackendState(t *testing.T) {
+	changed := newReloadOptions()
+	changed.OutlierDetection.ConsecutiveErrors = 5
+	tests := []struct {
+		name      string
+		options   Options
+		available []string
+	}{
+		{"unchanged options", newReloadOptions(), []string{"b"}},
+		{"changed outlier options", changed, []string{"a", "b"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			functionState := NewFunctionState("zone-a")
+			functionState.Put("f", Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}})
+			previous := newReloadedHandler(t, functionState, newReloadOptions(), nil)
+			for i := 0; i < 3; i++ {
+				previous.done("f", nil, "a", false, failure)
+			}
+			if ips := availableIps(previous, "f"); !reflect.DeepEqual(ips, []string{"b"}) {
+				t.Fatalf("a has not been ejected, available are %v", ips)
+			}
+
+			handler := newReloadedHandler(t, functionState, test.options, previous)
+			previous.Close()
+			if ips := availableIps(handler, "f"); !reflect.DeepEqual(ips, test.available) {
+				t.Errorf("available are %v after the reload, expected %v", ips, test.available)
+			}
+			breakerOptions := newReloadOptions().CircuitBreaker
+			if handler.component(breakerOptions) != previous.component(breakerOptions) {
+				t.Error("the circuit breaker has not been taken over")
+			}
+		})
+	}
+}
+
+func TestReloadedHandlerIsRefreshed(t *testing.T) {
+	functionState := NewFunctionState("zone-a")
+	functionState.Put("f", Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}})
+	options := newReloadOptions()
+	options.OutlierDetection.BaseEjectionTime = 10 * time.Millisecond
+	options.OutlierDetection.MaxEjectionTime = 10 * time.Millisecond
+	previous := newReloadedHandler(t, functionState, options, nil)
+	handler := newReloadedHandler(t, functionState, options, previous)
+	previous.Close()
+
+	for i := 0; i < 3; i++ {
+		handler.done("f", nil, "a", false, failure)
+	}
+	if ips := availableIps(handler, "f"); !reflect.DeepEqual(ips, []string{"b"}) {
+		t.Fatalf("a has not been ejected, available are %v", ips)
+	}
+	// the ejection ends after the previous handler has been closed
+	deadline := time.Now().Add(time.Second)
+	for len(availableIps(handler, "f")) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("a has not returned")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestReloadKeepsStrategies(t *testing.T) {
+	changed := newReloadOptions()
+	changed.Type = "lvs-wrr"
+	tests := []struct {
+		name    string
+		options Options
+		expect  string
+	}{
+		{"unchanged strategy", newReloadOptions(), "b"},
+		{"changed strategy", changed, "a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			functionState := NewFunctionState("zone-a")
+			functionState.Put("f", Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}})
+			previous := newReloadedHandler(t, functionState, newReloadOptions(), nil)
+			req := httptest.NewRequest(http.MethodGet, "/function/f/", nil)
+			if ip, _ := previous.table.Load().routes["f"].strategy.Select(req); ip != "a" {
+				t.Fatalf("selected %s first, expected a", ip)
+			}
+			handler := newReloadedHandler(t, functionState, test.options, previous)
+			if ip, _ := handler.table.Load().routes["f"].strategy.Select(req); ip != test.expect {
+				t.Errorf("selected %s after the reload, expected %s", ip, test.expect)
+			}
+		})
+	}
+}
+
+func TestComponentStopsWithTheLastHandler(t *testing.T) {
+	stopped := 0
+	c := newComponent(nil, nil, func() {
+		stopped++
+	})
+	first, second := &WeightedRoundRobinHandler{}, &WeightedRoundRobinHandler{}
+	first.use(c)
+	second.use(c)
+	first.Close()
+	if stopped != 0 {
+		t.Fatal("component stopped while another handler uses it")
+	}
+	second.Close()
+	if stopped != 1 {
+		t.Errorf("component stopped %d times, expected once", stopped)
+	}
+}
@@ -0,0 +1,209 @@
+package handler
+
+import (
+	"bytes"
+	"edgebench/go-load-balancer/pkg/env"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type RetryOptions struct {
+	// Statuses are the upstream status codes that are retried on another backend, connection errors are always retried
+	Statuses StatusCodes `yaml:"statuses"`
+	// BudgetPercent limits retries to this share of all requests, on top of MinRetriesPerSecond
+	BudgetPercent       int `yaml:"budget_percent"`
+	MinRetriesPerSecond int `yaml:"min_per_second"`
+	// MaxBodyBytes is the size up to which request bodies are buffered to be replayed, larger requests are not retried
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+// StatusCodes is a set of HTTP status codes, it is read from a list in YAML
+type StatusCodes map[int]bool
+
+func (codes *StatusCodes) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []int
+	if err := unmarshal(&list); err != nil {
+		return err
+	}
+	*codes = make(StatusCodes)
+	for _, code := range list {
+		(*codes)[code] = true
+	}
+	return nil
+}
+
+func NewDefaultRetryOptions() RetryOptions {
+	return RetryOptions{
+		Statuses: StatusCodes{
+			http.StatusBadGateway:         true,
+			http.StatusServiceUnavailable: true,
+			http.StatusGatewayTimeout:     true,
+		},
+		BudgetPercent:       20,
+		MinRetriesPerSecond: 3,
+		MaxBodyBytes:        64 * 1024,
+	}
+}
+
+// ReadRetryOptions overrides the options with the eb_go_lb_retry* variables of the environment
+func ReadRetryOptions(environment env.Environment, options RetryOptions) (RetryOptions, error) {
+	if fields, found, err := environment.LookupFields("eb_go_lb_retry_statuses"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_retry_statuses: %s", err)
+		}
+		options.Statuses = make(StatusCodes)
+		for _, field := range fields {
+			status, err := strconv.Atoi(field)
+			if err != nil {
+				return options, fmt.Errorf("eb_go_lb_retry_statuses: %s", err)
+			}
+			options.Statuses[status] = true
+		}
+	}
+	if percent, found, err := environment.LookupInt("eb_go_lb_retry_budget_percent"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_retry_budget_percent: %s", err)
+		}
+		options.BudgetPercent = int(percent)
+	}
+	if minRetries, found, err := environment.LookupInt("eb_go_lb_retry_min_per_second"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_retry_min_per_second: %s", err)
+		}
+		options.MinRetriesPerSecond = int(minRetries)
+	}
+	if maxBody, found, err := environment.LookupInt("eb_go_lb_retry_max_body_bytes"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_retry_max_body_bytes: %s", err)
+		}
+		options.MaxBodyBytes = maxBody
+	}
+	return options, nil
+}
+
+func (options RetryOptions) Validate() error {
+	if options.BudgetPercent < 0 || options.MinRetriesPerSecond < 0 || options.MaxBodyBytes < 0 {
+		return fmt.Errorf("retry budget and max body bytes must not be negative")
+	}
+	for status := range options.Statuses {
+		if status < 100 || status > 599 {
+			return fmt.Errorf("retry status %d is not a valid status code", status)
+		}
+	}
+	return nil
+}
+
+const maxRetryTokens = 100
+
+// retryBudget is a token bucket, every request deposits a fraction of a token and every retry withdraws one. Apart from
+// that, MinRetriesPerSecond retries are allowed, so functions with little traffic can be retried at all.
+type retryBudget struct {
+	mtx             sync.Mutex
+	ratio           float64
+	minPerSecond    int
+	tokens          float64
+	second          int64
+	retriesInSecond int
+}
+
+func newRetryBudget(options RetryOptions) *retryBudget {
+	return &retryBudget{
+		ratio:        float64(options.BudgetPercent) / 100,
+		minPerSecond: options.MinRetriesPerSecond,
+	}
+}
+
+func (budget *retryBudget) deposit() {
+	budget.mtx.Lock()
+	defer budget.mtx.Unlock()
+	budget.tokens += budget.ratio
+	if budget.tokens > maxRetryTokens {
+		budget.tokens = maxRetryTokens
+	}
+}
+
+func (budget *retryBudget) resetSecond() {
+	now := time.Now().Unix()
+	if now != budget.second {
+		budget.second = now
+		budget.retriesInSecond = 0
+	}
+}
+
+// allows returns true if the budget allows another retry
+func (budget *retryBudget) allows() bool {
+	budget.mtx.Lock()
+	defer budget.mtx.Unlock()
+	budget.resetSecond()
+	return budget.retriesInSecond < budget.minPerSecond || budget.tokens >= 1
+}
+
+// spend accounts for a retry. Concurrent retries that have been allowed at the same time may overdraw the budget
+// slightly, which is compensated by the following deposits.
+func (budget *retryBudget) spend() {
+	budget.mtx.Lock()
+	defer budget.mtx.Unlock()
+	budget.resetSecond()
+	if budget.retriesInSecond < budget.minPerSecond {
+		budget.retriesInSecond++
+	} else {
+		budget.tokens--
+	}
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
+
+// bufferBody reads the body into memory if the request may be replayed. It returns nil if the request must not be sent
+// more than once, in that case req.Body is left readable.
+func bufferBody(req *http.Request, policy FunctionPolicy, maxBytes int64) ([]byte, error) {
+	if (policy.RetryAttempts <= 1 && !policy.hedging()) || (!isIdempotent(req.Method) && !policy.RetryNonIdempotent) {
+		return nil, nil
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return []byte{}, nil
+	}
+	if req.ContentLength > maxBytes {
+		return nil, nil
+	}
+
+	buffered, err := io.ReadAll(io.LimitReader(req.Body, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buffered)) > maxBytes {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buffered), req.Body), req.Body}
+		return nil, nil
+	}
+	req.Body.Close()
+	return buffered, nil
+}
+
+// replay returns a copy of the request that can be modified and sent to a backend
+func replay(req *http.Request, body []byte) *http.Request {
+	clone := req.Clone(req.Context())
+	if body != nil {
+		clone.Body = io.NopCloser(bytes.NewReader(body))
+		clone.ContentLength = int64(len(body))
+		clone.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+		if len(body) == 0 {
+			clone.Body = http.NoBody
+		}
+	}
+	return clone
+}
@@ -0,0 +1,201 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRetryBudget(t *testing.T) {
+	tests := []struct {
+		name     string
+		options  RetryOptions
+		deposits int
+		retries  int
+	}{
+		{"minimum per second", RetryOptions{BudgetPercent: 0, MinRetriesPerSecond: 3}, 100, 3},
+		{"share of requests", RetryOptions{BudgetPercent: 25, MinRetriesPerSecond: 0}, 100, 25},
+		{"minimum and share", RetryOptions{BudgetPercent: 25, MinRetriesPerSecond: 2}, 20, 7},
+		{"tokens are capped", RetryOptions{BudgetPercent: 100, MinRetriesPerSecond: 0}, 1000, maxRetryTokens},
+		{"disabled", RetryOptions{}, 100, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			budget := newRetryBudget(test.options)
+			for i := 0; i < test.deposits; i++ {
+				budget.deposit()
+			}
+			retries := 0
+			for budget.allows() && retries <= 2*maxRetryTokens {
+				budget.spend()
+				retries++
+			}
+			if retries != test.retries {
+				t.Errorf("allowed %d retries, expected %d", retries, test.retries)
+			}
+		})
+	}
+}
+
+func TestBufferBody(t *testing.T) {
+	retries := FunctionPolicy{RetryAttempts: 3}
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		policy   FunctionPolicy
+		buffered bool
+	}{
+		{"idempotent", http.MethodPut, "payload", retries, true},
+		{"without body", http.MethodGet, "", retries, true},
+		{"not idempotent", http.MethodPost, "payload", retries, false},
+		{"non-idempotent retries allowed", http.MethodPost, "payload", FunctionPolicy{RetryAttempts: 3, RetryNonIdempotent: true}, true},
+		{"retries disabled", http.MethodGet, "payload", FunctionPolicy{RetryAttempts: 1}, false},
+		{"body too large", http.MethodPut, strings.Repeat("x", 17), retries, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(test.method, "/function/f/", strings.NewReader(test.body))
+			body, err := bufferBody(req, test.policy, 16)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if buffered := body != nil; buffered != test.buffered {
+				t.Fatalf("buffered is %t, expected %t", buffered, test.buffered)
+			}
+			if body != nil {
+				if string(body) != test.body {
+					t.Errorf("buffered '%s', expected '%s'", body, test.body)
+				}
+				return
+			}
+			// the request is sent once, so its body must still be complete
+			if read, _ := io.ReadAll(req.Body); string(read) != test.body {
+				t.Errorf("body is '%s' after buffering, expected '%s'", read, test.body)
+			}
+		})
+	}
+}
+
+// inFlightCounts counts the requests in flight per backend as reported to strategies
+type inFlightCounts struct {
+	mtx    sync.Mutex
+	counts map[string]int
+}
+
+func (c *inFlightCounts) add(ip string, delta int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.counts[ip] += delta
+}
+
+// stickyStrategy always selects the first backend, like a hash strategy for requests with the same key
+type stickyStrategy struct {
+	ip       string
+	inFlight *inFlightCounts
+}
+
+func (s *stickyStrategy) Select(*http.Request) (string, error) {
+	s.inFlight.add(s.ip, 1)
+	return s.ip, nil
+}
+
+func (s *stickyStrategy) Done(ip string, _ loadbalancer.Result) {
+	s.inFlight.add(ip, -1)
+}
+
+func newStickyFactory(inFlight *inFlightCounts) loadbalancer.Factory {
+	return func(weights loadbalancer.Weights, _ loadbalancer.LoadBalancingStrategy) (loadbalancer.LoadBalancingStrategy, error) {
+		if len(weights.Ips) == 0 {
+			return nil, errNoAvailableServers
+		}
+		return &stickyStrategy{ip: weights.Ips[0], inFlight: inFlight}, nil
+	}
+}
+
+// newTestBackend starts a backend that serves requests with handler and returns its address
+func newTestBackend(t *testing.T, handler http.HandlerFunc) string {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// respondWith returns a handler that responds with the status
+func respondWith(status int) http.HandlerFunc {
+	return func(res http.ResponseWriter, _ *http.Request) {
+		res.WriteHeader(status)
+	}
+}
+
+func newTestHandler(newStrategy loadbalancer.Factory, policy FunctionPolicy, functions map[string]Weights) *WeightedRoundRobinHandler {
+	functionState := NewFunctionState("zone-a")
+	for function, weights := range functions {
+		functionState.Put(function, weights)
+	}
+	matcher, _ := NewGatewayMatcher(nil, nil)
+	return newWeightedRoundRobinHandler(newForwarder("node-a", "zone-a", DefaultMaxHops, nil), matcher, NewDefaultLocalityOptions(),
+		functionState, newStrategy, Policies{Default: policy}, NewDefaultRetryOptions())
+}
+
+func TestRetryOnlyReportsSelectedBackends(t *testing.T) {
+	failing := newTestBackend(t, respondWith(http.StatusServiceUnavailable))
+	healthy := newTestBackend(t, respondWith(http.StatusOK))
+	inFlight := &inFlightCounts{counts: make(map[string]int)}
+	handler := newTestHandler(newStickyFactory(inFlight), FunctionPolicy{RetryAttempts: 2},
+		map[string]Weights{"f": {Ips: []string{failing, healthy}, Weights: []int{1, 1}}})
+
+	res := httptest.NewRecorder()
+	handler.Handle(res, httptest.NewRequest(http.MethodGet, "/function/f/", nil))
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d, expected the retry to succeed", res.Code)
+	}
+	// the strategy keeps selecting the failing backend, the retry falls back to the healthy one without the strategy
+	for ip, count := range inFlight.counts {
+		if count != 0 {
+			t.Errorf("strategy counts %d requests in flight on %s", count, ip)
+		}
+	}
+}
+
+// admitOnly admits the requests to the given backends
+type admitOnly map[string]bool
+
+func (admitted admitOnly) Admit(_ string, ip string) bool {
+	return admitted[ip]
+}
+
+func TestRetryWithoutAdmittingBackendReturnsLastFailure(t *testing.T) {
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	refused := strings.TrimPrefix(closed.URL, "http://")
+	tests := []struct {
+		name    string
+		failing string
+		status  int
+	}{
+		{"connection error", refused, http.StatusBadGateway},
+		{"retryable status", newTestBackend(t, respondWith(http.StatusGatewayTimeout)), http.StatusGatewayTimeout},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			healthy := newTestBackend(t, respondWith(http.StatusOK))
+			handler := newTestHandler(newStickyFactory(&inFlightCounts{counts: make(map[string]int)}), FunctionPolicy{RetryAttempts: 3},
+				map[string]Weights{"f": {Ips: []string{test.failing, healthy}, Weights: []int{1, 1}}})
+			// the healthy backend does not admit requests, e.g., because its circuit breaker is open
+			handler.admitters = append(handler.admitters, admitOnly{test.failing: true})
+
+			res := httptest.NewRecorder()
+			handler.Handle(res, httptest.NewRequest(http.MethodGet, "/function/f/", nil))
+			if res.Code != test.status {
+				t.Errorf("got status %d, expected %d of the failed attempt", res.Code, test.status)
+			}
+			if route := res.Header().Get(RouteHeader); !strings.HasSuffix(route, test.failing) {
+				t.Errorf("route is %s, expected it to end with %s", route, test.failing)
+			}
+		})
+	}
+}
@@ -2,27 +2,37 @@ package handler
 
 import (
 	"context"
-	"edgebench/go-load-balancer/pkg/env"
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"edgebench/go-load-balancer/pkg/tracing"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"go.etcd.io/etcd/mvcc/mvccpb"
 	"go.uber.org/zap"
 	"net/http"
-	"net/http/httputil"
-	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 import "go.etcd.io/etcd/clientv3"
 
 func NewWeightUpdate(function string, weights Weights) *WeightUpdate {
 	return &WeightUpdate{
+		Type:     Put,
 		Function: function,
 		Weights:  weights,
 	}
 }
 
+// NewFunctionRemoval returns an update that removes the function
+func NewFunctionRemoval(function string) *WeightUpdate {
+	return &WeightUpdate{
+		Type:     Delete,
+		Function: function,
+	}
+}
+
 type EtcdClient struct {
 	Client *clientv3.Client
 }
@@ -35,12 +45,23 @@ func (c EtcdClient) GetWithPrefix(pattern string) (*clientv3.GetResponse, error)
 }
 
 func (c EtcdClient) GetFunctionState(zone string) (*FunctionState, error) {
-	gresp, err := c.GetWithPrefix(fmt.Sprintf("golb/function/%s/", zone))
+	functions, _, err := c.getFunctions(FunctionKeyPrefix(zone))
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	zap.S().Debug(gresp)
 	state := NewFunctionState(zone)
+	state.functions.Store(&functions)
+	return state, nil
+}
+
+// getFunctions returns the weights of all functions under the prefix and the revision they have been read at
+func (c EtcdClient) getFunctions(prefix string) (map[string]Weights, int64, error) {
+	gresp, err := c.GetWithPrefix(prefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	zap.S().Debug(gresp)
+	functions := make(map[string]Weights)
 	for _, kv := range gresp.Kvs {
 		function, err := parseEtcdFunctionKey(string(kv.Key))
 		if err != nil {
@@ -53,9 +74,9 @@ func (c EtcdClient) GetFunctionState(zone string) (*FunctionState, error) {
 			continue
 		}
 
-		state.Functions[function] = weights
+		functions[function] = weights
 	}
-	return state, nil
+	return functions, gresp.Header.Revision, nil
 }
 
 func NewEtcdClient(url string) (*EtcdClient, error) {
@@ -72,22 +93,26 @@ func NewEtcdClient(url string) (*EtcdClient, error) {
 	}
 }
 
-func NewEtcdClientFromEnv() (*EtcdClient, error) {
-	etcdUrl, found := env.OsEnv.Lookup("eb_go_lb_etcd_host")
-	if !found {
-		etcdUrl = "localhost:2379"
-	}
-	zap.S().Infow("Connect to etcd", "etcdUrl", etcdUrl)
-	return NewEtcdClient(etcdUrl)
-}
-
-type WeightUpdater interface {
-	GetUpdates(string) chan *WeightUpdate
-}
+const (
+	minWatchBackoff = 500 * time.Millisecond
+	maxWatchBackoff = 30 * time.Second
+)
 
+// EtcdWeightUpdater watches the weights of the functions of a zone. It remembers the revision and the weights it has
+// seen last, so a broken watch is resumed without losing updates. If etcd compacted the revision in the meantime, the
+// updater reads all weights again and sends the differences to the known weights.
 type EtcdWeightUpdater struct {
 	etcdClient *EtcdClient
 	Zone       string
+	revision   int64
+	known      map[string]Weights
+	ctx        context.Context
+	cancel     context.CancelFunc
+	metrics    *Metrics
+}
+
+func FunctionKeyPrefix(zone string) string {
+	return fmt.Sprintf("golb/function/%s/", zone)
 }
 
 func parseWeights(msg string) (Weights, error) {
@@ -96,6 +121,9 @@ func parseWeights(msg string) (Weights, error) {
 	if err != nil {
 		return Weights{}, err
 	}
+	if err := validateWeights(weights); err != nil {
+		return Weights{}, err
+	}
 	return weights, nil
 }
 
@@ -107,214 +135,563 @@ func parseEtcdFunctionKey(key string) (string, error) {
 	return split[3], nil
 }
 
-func (updater EtcdWeightUpdater) GetUpdates(key string) chan *WeightUpdate {
+// LoadFunctionState fills the state with the weights that are currently stored in etcd. A following GetUpdates call
+// watches for changes from the revision of this snapshot on.
+func (updater *EtcdWeightUpdater) LoadFunctionState(state *FunctionState) error {
+	functions, revision, err := updater.etcdClient.getFunctions(FunctionKeyPrefix(state.Zone))
+	if err != nil {
+		return err
+	}
+	for function, weights := range functions {
+		state.Put(function, weights)
+	}
+	updater.Zone = state.Zone
+	updater.known = functions
+	updater.revision = revision
+	updater.metrics.setWatchRevision(revision)
+	return nil
+}
+
+func (updater *EtcdWeightUpdater) GetUpdates(key string) chan *WeightUpdate {
 	updates := make(chan *WeightUpdate)
 	go func() {
-
-		//updates <- NewWeightUpdate("nginx", []string{"10.0.0.1"}, []float64{0.3})
-		ch := updater.etcdClient.Client.Watch(context.TODO(), key, clientv3.WithPrefix())
-		for resp := range ch {
-			for _, event := range resp.Events {
-				switch event.Type {
-				case mvccpb.PUT:
-					function, err := parseEtcdFunctionKey(string(event.Kv.Key))
-					if err != nil {
-						zap.S().Error(err)
-					}
-					weights, err := parseWeights(string(event.Kv.Value))
-					if err != nil {
-						zap.S().Errorf("error parsing weight update: %s", err)
-						continue
-					}
-					zap.S().Debugw("put", "function", function, "weights", weights)
-					updates <- NewWeightUpdate(function, weights)
+		defer close(updates)
+		backoff := minWatchBackoff
+		resync := updater.revision == 0
+		for updater.ctx.Err() == nil {
+			if resync {
+				if err := updater.resync(key, updates); err != nil {
+					zap.S().Errorf("error reading weights from etcd, retry in %s: %s", backoff, err)
+					backoff = updater.sleepBackoff(backoff)
+					continue
 				}
+				resync = false
 			}
+
+			compacted, progressed := updater.watch(key, updates)
+			if updater.ctx.Err() != nil {
+				return
+			}
+			updater.metrics.watchRestarted(compacted)
+			if compacted {
+				zap.S().Warnf("etcd revision %d has been compacted, read all weights again", updater.revision+1)
+				resync = true
+				continue
+			}
+			if progressed {
+				backoff = minWatchBackoff
+			}
+			zap.S().Warnf("etcd watch on %s closed at revision %d, resume in %s", key, updater.revision, backoff)
+			backoff = updater.sleepBackoff(backoff)
 		}
 	}()
 	return updates
 }
 
-func NewEtcdWeightUpdater(client *EtcdClient) WeightUpdater {
-	return EtcdWeightUpdater{
-		etcdClient: client,
-	}
+// Instrument reports the state of the watch to metrics, it has to be called before GetUpdates
+func (updater *EtcdWeightUpdater) Instrument(metrics *Metrics) {
+	updater.metrics = metrics
 }
 
-type WeightedRoundRobinHandler struct {
-	functionState              *FunctionState
-	wrrInstancesWithoutGateway map[string]*WRR
-	wrrInstances               map[string]*WRR
-	ForwardMessage             string
-	NodeName                   string
-	Gateways                   map[string]bool
+// Close stops watching and closes the etcd client, the channel returned by GetUpdates is closed afterwards
+func (updater *EtcdWeightUpdater) Close() error {
+	updater.cancel()
+	return updater.etcdClient.Client.Close()
 }
 
-func (handler *WeightedRoundRobinHandler) HandleWeightUpdate(update *WeightUpdate) {
-	zap.S().Debugf("WRR - Got weight update: %s - ips: %s, weights: %s", update.Function, update.Weights.Ips, update.Weights.Weights)
-	state := handler.functionState
-	state.Functions[update.Function] = update.Weights
+// sleepBackoff waits for the backoff or until the updater is closed and returns the next backoff
+func (updater *EtcdWeightUpdater) sleepBackoff(backoff time.Duration) time.Duration {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-updater.ctx.Done():
+	}
+	backoff *= 2
+	if backoff > maxWatchBackoff {
+		backoff = maxWatchBackoff
+	}
+	return backoff
+}
 
-	wrr, err := NewWRR(update.Weights)
-	val, ok := handler.wrrInstances[update.Function]
+// watch sends the updates after the last seen revision until the watch breaks. It returns whether the watch broke
+// because the revision has been compacted and whether any response has been received.
+func (updater *EtcdWeightUpdater) watch(key string, updates chan<- *WeightUpdate) (compacted bool, progressed bool) {
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(updater.ctx))
+	defer cancel()
+	defer updater.metrics.setWatchUp(false)
 
-	if ok {
-		wrr, err = NewWRRWithLast(update.Weights, val.Last)
+	ch := updater.etcdClient.Client.Watch(ctx, key, clientv3.WithPrefix(), clientv3.WithRev(updater.revision+1), clientv3.WithCreatedNotify())
+	for resp := range ch {
+		if resp.Created {
+			updater.metrics.setWatchUp(true)
+			continue
+		}
+		if resp.CompactRevision != 0 {
+			return true, progressed
+		}
+		if err := resp.Err(); err != nil {
+			zap.S().Errorf("etcd watch error: %s", err)
+			return false, progressed
+		}
+		progressed = true
+		for _, event := range resp.Events {
+			updater.apply(event, updates)
+		}
+		if resp.Header.Revision > updater.revision {
+			updater.revision = resp.Header.Revision
+			updater.metrics.setWatchRevision(updater.revision)
+		}
 	}
+	return false, progressed
+}
 
+// apply adds the watched event to the known weights and sends the corresponding update
+func (updater *EtcdWeightUpdater) apply(event *clientv3.Event, updates chan<- *WeightUpdate) {
+	function, err := parseEtcdFunctionKey(string(event.Kv.Key))
 	if err != nil {
 		zap.S().Error(err)
-	} else {
-		handler.wrrInstances[update.Function] = wrr
-
-		wrrWithoutGateway, _ := NewWRR(filterGateway(update.Weights))
-		val, ok := handler.wrrInstancesWithoutGateway[update.Function]
-		if ok {
-			wrrWithoutGateway, _ = NewWRRWithLast(filterGateway(update.Weights), val.Last)
+		return
+	}
+	switch event.Type {
+	case mvccpb.PUT:
+		weights, err := parseWeights(string(event.Kv.Value))
+		if err != nil {
+			zap.S().Errorf("error parsing weight update: %s", err)
+			return
 		}
-		handler.wrrInstancesWithoutGateway[update.Function] = wrrWithoutGateway
+		zap.S().Debugw("put", "function", function, "weights", weights)
+		updater.known[function] = weights
+		updates <- NewWeightUpdate(function, weights)
+	case mvccpb.DELETE:
+		zap.S().Debugw("delete", "function", function)
+		delete(updater.known, function)
+		updates <- NewFunctionRemoval(function)
 	}
 }
 
-func removeWeight(slice []int, s int) []int {
-	return append(slice[:s], slice[s+1:]...)
+// resync reads all weights and sends the updates that turn the known weights into the current ones
+func (updater *EtcdWeightUpdater) resync(key string, updates chan<- *WeightUpdate) error {
+	functions, revision, err := updater.etcdClient.getFunctions(key)
+	if err != nil {
+		return err
+	}
+	updater.replace(functions, revision, updates)
+	return nil
 }
 
-func removeIp(slice []string, s int) []string {
-	return append(slice[:s], slice[s+1:]...)
+// replace sends the updates that turn the known weights into the weights of the snapshot and continues from its revision
+func (updater *EtcdWeightUpdater) replace(functions map[string]Weights, revision int64, updates chan<- *WeightUpdate) {
+	for _, update := range diffFunctions(updater.known, functions) {
+		updates <- update
+	}
+	updater.known = functions
+	updater.revision = revision
+	updater.metrics.setWatchRevision(revision)
 }
 
-func filterGateway(weights Weights) Weights {
-	index := -1
-	for i, ip := range weights.Ips {
-		if strings.Contains(ip, "10.0.") {
-			index = i
-			break
-		}
+func NewEtcdWeightUpdater(client *EtcdClient) *EtcdWeightUpdater {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &EtcdWeightUpdater{
+		etcdClient: client,
+		known:      make(map[string]Weights),
+		ctx:        ctx,
+		cancel:     cancel,
 	}
+}
 
-	if index != -1 {
-		return Weights{
-			Ips:     removeIp(weights.Ips, index),
-			Weights: removeWeight(weights.Weights, index),
-		}
-	} else {
-		return weights
+// route holds the strategy of a function and the backends it selects from
+type route struct {
+	strategy  loadbalancer.LoadBalancingStrategy
+	available Weights
+	// fallback are the available backends of lower priorities, they are used if no available backend admits a request
+	fallback Weights
+	gateways map[string]bool
+}
+
+// routingTable is an immutable snapshot of the functions and their routes. Updates build a modified copy and swap it
+// in, so requests are routed without locking.
+type routingTable struct {
+	functions            map[string]Weights
+	routes               map[string]route
+	routesWithoutGateway map[string]route
+}
+
+func (table *routingTable) clone() *routingTable {
+	clone := &routingTable{
+		functions:            table.functions,
+		routes:               make(map[string]route, len(table.routes)),
+		routesWithoutGateway: make(map[string]route, len(table.routesWithoutGateway)),
+	}
+	for function, r := range table.routes {
+		clone.routes[function] = r
+	}
+	for function, r := range table.routesWithoutGateway {
+		clone.routesWithoutGateway[function] = r
 	}
+	return clone
+}
 
+// WeightedRoundRobinHandler proxies function calls to the backend selected by a loadbalancer.LoadBalancingStrategy.
+// By default, the strategy is weighted round-robin.
+type WeightedRoundRobinHandler struct {
+	forwarder
+	functionState *FunctionState
+	newStrategy   loadbalancer.Factory
+	gateways      *GatewayMatcher
+	locality      LocalityOptions
+	// updateMtx serializes the updates of the routing table
+	updateMtx    sync.Mutex
+	table        atomic.Pointer[routingTable]
+	filters      []BackendFilter
+	observers    []ResultObserver
+	admitters    []BackendAdmitter
+	pruners      []BackendPruner
+	policies     Policies
+	retryOptions RetryOptions
+	retryBudget  *retryBudget
+	latencyMtx   sync.Mutex
+	latencies    map[string]*latencyWindow
+	metrics      *Metrics
+	tracer       *tracing.Tracer
+	overrides    *Overrides
+	// options are the options the handler has been created with, a handler created on a reload compares them to its own
+	options    Options
+	components []*component
+	// closers stop the background work of the handler, e.g., health checks
+	closers []func()
 }
 
-func NewWeightedRoundRobinHandler(gateways map[string]bool, functionState *FunctionState) *WeightedRoundRobinHandler {
-	wrrInstances := make(map[string]*WRR)
-	wrrInstancesWithoutGateway := make(map[string]*WRR)
-	for function, weights := range functionState.Functions {
-		wrr, err := NewWRR(weights)
-		if err != nil {
-			zap.S().Info(err)
-			continue
-		}
-		wrrWithoutGateway, _ := NewWRR(filterGateway(weights))
-		wrrInstances[function] = wrr
-		wrrInstancesWithoutGateway[function] = wrrWithoutGateway
+func (handler *WeightedRoundRobinHandler) HandleWeightUpdate(update *WeightUpdate) {
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	state := handler.functionState
+	table := handler.table.Load().clone()
+	if update.Type == Delete {
+		zap.S().Debugf("WRR - Remove function: %s", update.Function)
+		state.Remove(update.Function)
+		delete(table.routes, update.Function)
+		delete(table.routesWithoutGateway, update.Function)
+		handler.latencyMtx.Lock()
+		delete(handler.latencies, update.Function)
+		handler.latencyMtx.Unlock()
+	} else {
+		zap.S().Debugf("WRR - Got weight update: %s - ips: %s, weights: %s", update.Function, update.Weights.Ips, update.Weights.Weights)
+		state.Put(update.Function, update.Weights)
+		handler.updateRoutes(table, update.Function, update.Weights)
+	}
+	table.functions = state.Functions()
+	handler.table.Store(table)
+	handler.metrics.observeWeightUpdate(update)
+	for _, pruner := range handler.pruners {
+		pruner.Prune(table.functions)
 	}
+}
 
-	nodeName, found := env.OsEnv.Lookup("eb_go_lb_node_name")
-	if !found {
-		nodeName = env.OsEnv.Get("HOSTNAME")
+// Instrument reports requests and weight updates to metrics, it has to be called before the handler serves requests
+func (handler *WeightedRoundRobinHandler) Instrument(metrics *Metrics) {
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	handler.metrics = metrics
+	handler.observers = append(handler.observers, metrics)
+	for function, weights := range handler.table.Load().functions {
+		metrics.setWeights(function, weights)
+	}
+}
+
+// Close stops the background work of the handler. Requests that are in flight are not affected.
+func (handler *WeightedRoundRobinHandler) Close() error {
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	for _, closer := range handler.closers {
+		closer()
 	}
-	return &WeightedRoundRobinHandler{
-		functionState:              functionState,
-		wrrInstances:               wrrInstances,
-		wrrInstancesWithoutGateway: wrrInstancesWithoutGateway,
-		ForwardMessage:             fmt.Sprintf("X-Forwarded-Host-%s", nodeName),
-		NodeName:                   nodeName,
-		Gateways:                   gateways,
+	handler.closers = nil
+	return nil
+}
+
+// AddBackendFilter excludes the backends that are not available according to the filter. Filters must call
+// RefreshBackend whenever the availability of a backend changes.
+func (handler *WeightedRoundRobinHandler) AddBackendFilter(filter BackendFilter) {
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	handler.filters = append(handler.filters, filter)
+	table := handler.table.Load().clone()
+	for function, weights := range table.functions {
+		handler.updateRoutes(table, function, weights)
 	}
+	handler.table.Store(table)
+}
+
+// AddResultObserver registers an observer that is notified about the outcome of every proxied request. Observers have
+// to be added before the handler serves requests.
+func (handler *WeightedRoundRobinHandler) AddResultObserver(observer ResultObserver) {
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	handler.observers = append(handler.observers, observer)
+}
+
+// AddBackendAdmitter registers an admitter that is asked before a request is sent to a backend. Admitters have to be
+// added before the handler serves requests.
+func (handler *WeightedRoundRobinHandler) AddBackendAdmitter(admitter BackendAdmitter) {
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	handler.admitters = append(handler.admitters, admitter)
 }
 
-func (handler *WeightedRoundRobinHandler) selectIp(req *http.Request) (string, error) {
-	// Algorithm based on http://kb.linuxvirtualserver.org/wiki/Weighted_Round-Robin_Scheduling
+// AddBackendPruner registers a component that keeps state per backend and forgets removed backends. Pruners have to be
+// added before the handler serves requests.
+func (handler *WeightedRoundRobinHandler) AddBackendPruner(pruner BackendPruner) {
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	handler.pruners = append(handler.pruners, pruner)
+}
 
-	// parse url for function
-	// localhost:8080/function/nginx
-	// localhost:8080/function/responder/static?time=10
-	uri := req.URL.RequestURI()
-	split := strings.Split(uri, "/")
-	if len(split) != 3 && len(split) != 4 {
-		return "", fmt.Errorf("invalid URL format: %s\n", uri)
+// RefreshFunction rebuilds the routes of the function, or of all functions if function is empty
+func (handler *WeightedRoundRobinHandler) RefreshFunction(function string) {
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	table := handler.table.Load().clone()
+	for name, weights := range table.functions {
+		if function == "" || name == function {
+			handler.updateRoutes(table, name, weights)
+		}
 	}
+	handler.table.Store(table)
+}
 
-	if split[1] != "function" {
-		return "", fmt.Errorf("not a function call: %s\n", uri)
+// RefreshBackend rebuilds the routes of all functions that are served by the given ip
+func (handler *WeightedRoundRobinHandler) RefreshBackend(ip string) {
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	table := handler.table.Load().clone()
+	for function, weights := range table.functions {
+		for _, functionIp := range weights.Ips {
+			if functionIp == ip {
+				handler.updateRoutes(table, function, weights)
+				break
+			}
+		}
 	}
+	handler.table.Store(table)
+}
 
-	function := split[2]
+func (handler *WeightedRoundRobinHandler) available(function string, weights Weights) Weights {
+	return weights.Filter(func(ip string) bool {
+		for _, filter := range handler.filters {
+			if !filter.Available(function, ip) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func (handler *WeightedRoundRobinHandler) updateRoutes(table *routingTable, function string, weights Weights) {
+	weights = handler.overrides.Apply(function, weights)
+	available := handler.available(function, weights)
+	gateways := handler.gateways.Gateways(weights)
+	handler.updateRoute(table.routes, function, weights, available, gateways)
+	withoutGateway := available.Filter(func(ip string) bool {
+		return !gateways[ip]
+	})
+	handler.updateRoute(table.routesWithoutGateway, function, weights, withoutGateway, gateways)
+}
+
+// updateRoute replaces the route of the function with a route to the available backends of the highest priority,
+// weights are all backends of the function
+func (handler *WeightedRoundRobinHandler) updateRoute(routes map[string]route, function string, weights Weights, available Weights, gateways map[string]bool) {
+	weights, available, fallback := selectTier(weights, available)
+	strategy, available, err := handler.newRouteStrategy(weights, available, gateways, routes[function].strategy)
+	if err != nil {
+		zap.S().Debugf("no available servers for function %s: %s", function, err)
+		delete(routes, function)
+		return
+	}
+	routes[function] = route{
+		strategy:  strategy,
+		available: available,
+		fallback:  fallback,
+		gateways:  gateways,
+	}
+}
 
-	// get weights
-	var wrr *WRR
+func newWeightedRoundRobinHandler(forwarder forwarder, gateways *GatewayMatcher, locality LocalityOptions, functionState *FunctionState, newStrategy loadbalancer.Factory, policies Policies, retryOptions RetryOptions) *WeightedRoundRobinHandler {
+	handler := &WeightedRoundRobinHandler{
+		forwarder:     forwarder,
+		functionState: functionState,
+		newStrategy:   newStrategy,
+		gateways:      gateways,
+		locality:      locality,
+		policies:      policies,
+		retryOptions:  retryOptions,
+		retryBudget:   newRetryBudget(retryOptions),
+		latencies:     make(map[string]*latencyWindow),
+	}
+	table := &routingTable{
+		functions:            functionState.Functions(),
+		routes:               make(map[string]route),
+		routesWithoutGateway: make(map[string]route),
+	}
+	for function, weights := range table.functions {
+		handler.updateRoutes(table, function, weights)
+	}
+	handler.table.Store(table)
+	return handler
+}
+
+// selectRoute returns the route of the function, which only contains gateways if the request may pass another load
+// balancer. Requests whose hops have been removed because they came from an untrusted peer are never sent to
+// gateways, the hops of such a request are unknown, so sending it on could create a loop.
+func (handler *WeightedRoundRobinHandler) selectRoute(function string, chain hopChain, untrusted bool) (route, error) {
+	table := handler.table.Load()
+	var r route
 	var found bool
-	forwarded := len(req.Header.Get("X-Forwarded-For")) >= 1
-	if !forwarded {
-		wrr, found = handler.wrrInstances[function]
-		if !found {
-			return "", fmt.Errorf("no servers found for function: %s", function)
-		}
+	if !untrusted && handler.mayUseGateway(chain) {
+		r, found = table.routes[function]
 	} else {
-		wrr, found = handler.wrrInstancesWithoutGateway[function]
-		if !found {
-			return "", fmt.Errorf("no servers found for function: %s", function)
+		r, found = table.routesWithoutGateway[function]
+	}
+	if !found {
+		if _, known := table.functions[function]; known {
+			return r, fmt.Errorf("%w for function: %s", errNoAvailableServers, function)
 		}
+		return r, fmt.Errorf("no servers found for function: %s", function)
 	}
+	return r, nil
+}
 
-	ip := wrr.Next()
+// done reports the result of a request to all observers and, if the strategy selected the backend, to the strategy
+func (handler *WeightedRoundRobinHandler) done(function string, strategy loadbalancer.LoadBalancingStrategy, ip string, selected bool, result loadbalancer.Result) {
+	if selected {
+		strategy.Done(ip, result)
+	}
+	for _, observer := range handler.observers {
+		observer.Observe(function, ip, result)
+	}
+}
 
-	return ip, nil
+// selectBackend asks the strategy for a backend the request has not been sent to yet and that admits the request. If
+// the strategy keeps returning tried backends, e.g., because it hashes the request, the first untried available backend
+// is used instead. selected is false in this case, the strategy must not be told about the result of a backend it did
+// not select. If no available backend admits the request, it falls through to the backends of lower priorities. Backends
+// that do not admit the request are added to tried.
+func (handler *WeightedRoundRobinHandler) selectBackend(req *http.Request, function string, r route, tried map[string]bool) (ip string, selected bool, err error) {
+	for range r.available.Ips {
+		ip, err := r.strategy.Select(req)
+		if err != nil {
+			return "", false, err
+		}
+		if !tried[ip] {
+			if handler.admit(function, ip) {
+				return ip, true, nil
+			}
+			tried[ip] = true
+		}
+		r.strategy.Done(ip, loadbalancer.Result{Err: loadbalancer.ErrSkipped})
+	}
+	for _, ips := range [][]string{r.available.Ips, r.fallback.Ips} {
+		for _, ip := range ips {
+			if !tried[ip] {
+				if handler.admit(function, ip) {
+					return ip, false, nil
+				}
+				tried[ip] = true
+			}
+		}
+	}
+	return "", false, fmt.Errorf("%w for function: %s", errNoAvailableServers, function)
+}
+
+func (handler *WeightedRoundRobinHandler) admit(function string, ip string) bool {
+	for _, admitter := range handler.admitters {
+		if !admitter.Admit(function, ip) {
+			return false
+		}
+	}
+	return true
 }
 
 func (handler *WeightedRoundRobinHandler) Handle(res http.ResponseWriter, req *http.Request) {
-	var target string
-	ip, err := handler.selectIp(req)
-	if err == nil {
-		target = fmt.Sprintf("http://%s", ip)
-	} else {
-		text := fmt.Sprintf("error selecting server: %s - in %s", err, handler.functionState.Zone)
-		zap.S().Info(text)
-		res.WriteHeader(404)
-		res.Write([]byte(text))
+	function, err := parseFunction(req)
+	if err != nil {
+		writeSelectError(res, err, handler.functionState.Zone)
+		return
+	}
+	untrusted := handler.removeUntrustedHeaders(req)
+	span := handler.startSpan(req, function)
+	if span != nil {
+		recorder := &statusRecorder{ResponseWriter: res}
+		res = recorder
+		defer endSpan(span, recorder)
+	}
+	chain := parseHops(req.Header)
+	if err := handler.checkHops(chain); err != nil {
+		writeHopError(res, err, handler.addHop(req, chain), handler.functionState.Zone)
+		return
+	}
+	chain = handler.addHop(req, chain)
+	handler.setForwardedHeaders(req)
+	r, err := handler.selectRoute(function, chain, untrusted)
+	if err != nil {
+		writeSelectError(res, err, handler.functionState.Zone)
 		return
 	}
-	parsedUrl, _ := url.Parse(target)
-
-	req.Header.Set("X-Forwarded-For", handler.NodeName)
-	res.Header().Set("X-Forwarded-For", handler.NodeName)
-
-	// Update the headers to allow for SSL redirection
-	req.URL.Host = parsedUrl.Host
 
-	if _, found := handler.Gateways[parsedUrl.Host]; !found {
-		uri := req.URL.RequestURI()
-		split := strings.Split(uri, "/")
-		params := ""
-		if len(split) == 4 {
-			params = split[3]
+	policy := handler.policies.For(function)
+	handler.retryBudget.deposit()
+	body, err := bufferBody(req, policy, handler.retryOptions.MaxBodyBytes)
+	if err != nil {
+		zap.S().Infof("error reading request body: %s", err)
+		res.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if body != nil && policy.hedging() {
+		handler.hedge(res, req, function, r, body, policy, span)
+		return
+	}
+	retryable := body != nil
+
+	tried := make(map[string]bool)
+	var lastIp string
+	var last loadbalancer.Result
+	for attempt := 1; ; attempt++ {
+		ip, selected, err := handler.selectBackend(req, function, r, tried)
+		if err != nil && attempt > 1 {
+			// no other backend admits the request, so the client gets the failure of the last one
+			writeLastFailure(res, routeOf(req, lastIp), last)
+			return
 		}
-		target = fmt.Sprintf("http://%s/%s", parsedUrl.Host, params)
-		parsedUrl2, _ := url.Parse(target)
+		if err != nil {
+			writeSelectError(res, err, handler.functionState.Zone)
+			return
+		}
+		tried[ip] = true
+		span.SetAttribute("golb.backend", ip)
+		span.SetAttribute("golb.attempts", attempt)
 
-		req.URL = parsedUrl2
+		var retryStatuses map[int]bool
+		if retryable && attempt < policy.RetryAttempts && len(tried) < len(r.available.Ips)+len(r.fallback.Ips) && handler.retryBudget.allows() {
+			retryStatuses = handler.retryOptions.Statuses
+		}
 
-		req.RequestURI = target
-	} else {
-		// ignore
-	}
-	proxy := httputil.NewSingleHostReverseProxy(parsedUrl)
-	//req.URL.Scheme = parsedUrl.Scheme
-	req.Header.Set(handler.ForwardMessage, fmt.Sprintf("%.7f", float64(time.Now().UnixNano())/float64(1000000000)))
-	res.Header().Set(handler.ForwardMessage, fmt.Sprintf("%.7f", float64(time.Now().UnixNano())/float64(1000000000)))
-	res.Header().Set("X-Final-Host", parsedUrl.Host)
-	req.Header.Set("X-Final-Host", parsedUrl.Host)
-	req.Host = parsedUrl.Host
-	zap.S().Debug("direct request ", req.RequestURI, " to ", target)
-	// Note that ServeHttp is non blocking and uses a go routine under the hood
-	proxy.ServeHTTP(res, req)
+		attemptSpan := startAttemptSpan(span, function, ip, attempt)
+		outgoing := replay(req, body)
+		attemptSpan.Inject(outgoing.Header)
+		finished := handler.metrics.started(function, ip, r.gateways[ip])
+		result := handler.forward(res, outgoing, ip, r.gateways[ip], retryStatuses, nil)
+		finished()
+		endAttemptSpan(attemptSpan, result)
+		handler.done(function, r.strategy, ip, selected, result)
+
+		if retryStatuses == nil || (result.Err == nil && !retryStatuses[result.StatusCode]) {
+			return
+		}
+		if req.Context().Err() != nil {
+			return
+		}
+		lastIp, last = ip, result
+		handler.retryBudget.spend()
+		zap.S().Debugf("retry request to %s after attempt %d on %s failed", function, attempt, ip)
+	}
 }
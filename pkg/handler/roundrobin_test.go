@@ -0,0 +1,162 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flaky returns a handler that fails every other request
+func flaky() http.HandlerFunc {
+	var requests atomic.Int64
+	return func(res http.ResponseWriter, _ *http.Request) {
+		if requests.Add(1)%2 == 0 {
+			res.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		time.Sleep(time.Millisecond)
+		res.WriteHeader(http.StatusOK)
+	}
+}
+
+// TestHandlerConcurrentUpdates sends requests while the weights change and the routes are refreshed, run it with -race
+func TestHandlerConcurrentUpdates(t *testing.T) {
+	for _, strategy := range []HandlerType{"wrr", "lvs-wrr", "least", "p2c", "hash"} {
+		t.Run(string(strategy), func(t *testing.T) {
+			healthy := newTestBackend(t, respondWith(http.StatusOK))
+			flaky := newTestBackend(t, flaky())
+			remote := newTestBackend(t, respondWith(http.StatusOK))
+			weightSets := []Weights{
+				{Ips: []string{healthy, flaky, remote}, Weights: []int{1, 1, 1}, Zones: []string{"zone-a", "zone-a", "zone-b"}},
+				{Ips: []string{healthy, remote}, Weights: []int{2, 1}, Zones: []string{"zone-a", "zone-b"}},
+				{Ips: []string{flaky, remote}, Weights: []int{1, 3}, Zones: []string{"zone-a", "zone-b"}, Priorities: []int{0, 1}},
+			}
+
+			options := NewDefaultOptions()
+			options.Type = strategy
+			options.Strategy["hash_key"] = "header:X-Key"
+			options.Policies.Default.RetryAttempts = 3
+			options.Policies.Functions["hedged"] = FunctionPolicy{RetryAttempts: 1, HedgeDelay: Duration(time.Millisecond)}
+			options.OutlierDetection.Enabled = true
+			options.CircuitBreaker.Enabled = true
+			options.CircuitBreaker.OpenDuration = 10 * time.Millisecond
+			options.Locality.Enabled = true
+			functionState := NewFunctionState("zone-a")
+			functionState.Put("f", weightSets[0])
+			functionState.Put("hedged", weightSets[0])
+			h, err := NewHandlerWithOptions(functionState, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler := h.(*WeightedRoundRobinHandler)
+			defer handler.Close()
+
+			var wg sync.WaitGroup
+			stop := make(chan struct{})
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					case <-time.After(time.Millisecond):
+					}
+					if i%7 == 6 {
+						handler.HandleWeightUpdate(NewFunctionRemoval("f"))
+					} else {
+						handler.HandleWeightUpdate(NewWeightUpdate("f", weightSets[i%len(weightSets)]))
+					}
+					handler.HandleWeightUpdate(NewWeightUpdate("hedged", weightSets[(i+1)%len(weightSets)]))
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					case <-time.After(time.Millisecond):
+					}
+					handler.RefreshBackend(flaky)
+					handler.RefreshFunction("")
+				}
+			}()
+
+			var clients sync.WaitGroup
+			for client := 0; client < 8; client++ {
+				clients.Add(1)
+				go func(client int) {
+					defer clients.Done()
+					for i := 0; i < 50; i++ {
+						function := "f"
+						if i%3 == 0 {
+							function = "hedged"
+						}
+						req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/function/%s/", function), nil)
+						req.Header.Set("X-Key", fmt.Sprint(client*100+i))
+						res := httptest.NewRecorder()
+						handler.Handle(res, req)
+						switch res.Code {
+						// the function is unknown while it is removed
+						case http.StatusOK, http.StatusNotFound, http.StatusBadGateway, http.StatusServiceUnavailable:
+						default:
+							t.Errorf("unexpected status %d", res.Code)
+						}
+					}
+				}(client)
+			}
+			clients.Wait()
+			close(stop)
+			wg.Wait()
+		})
+	}
+}
+
+func TestHandlerDelete(t *testing.T) {
+	backend := newTestBackend(t, respondWith(http.StatusOK))
+	weights := Weights{Ips: []string{backend}, Weights: []int{1}}
+	handler := newTestHandler(newStickyFactory(&inFlightCounts{counts: make(map[string]int)}), FunctionPolicy{},
+		map[string]Weights{"f": weights, "g": weights})
+	status := func(function string) int {
+		res := httptest.NewRecorder()
+		handler.Handle(res, httptest.NewRequest(http.MethodGet, "/function/"+function+"/", nil))
+		return res.Code
+	}
+	if code := status("f"); code != http.StatusOK {
+		t.Fatalf("got status %d before the removal", code)
+	}
+
+	handler.HandleWeightUpdate(NewFunctionRemoval("f"))
+	table := handler.table.Load()
+	if _, found := table.routes["f"]; found {
+		t.Error("the route of f has not been removed")
+	}
+	if _, found := table.routesWithoutGateway["f"]; found {
+		t.Error("the route without gateways of f has not been removed")
+	}
+	if _, found := table.functions["f"]; found {
+		t.Error("f is still a function")
+	}
+	if code := status("f"); code != http.StatusNotFound {
+		t.Errorf("got status %d for a removed function, expected 404", code)
+	}
+	if code := status("g"); code != http.StatusOK {
+		t.Errorf("got status %d for g, expected it to be unaffected", code)
+	}
+
+	// a function without backends is known, but not available
+	handler.HandleWeightUpdate(NewWeightUpdate("g", Weights{Ips: []string{}, Weights: []int{}}))
+	if code := status("g"); code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for a function without backends, expected 503", code)
+	}
+
+	handler.HandleWeightUpdate(NewWeightUpdate("f", weights))
+	if code := status("f"); code != http.StatusOK {
+		t.Errorf("got status %d after f has been added again", code)
+	}
+}
@@ -0,0 +1,62 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/loadbalancer"
+	"edgebench/go-load-balancer/pkg/tracing"
+	"fmt"
+	"net/http"
+)
+
+// Traced is implemented by handlers that record a span per request
+type Traced interface {
+	Trace(tracer *tracing.Tracer)
+}
+
+// Trace records a span per request with tracer, it has to be called before the handler serves requests
+func (handler *WeightedRoundRobinHandler) Trace(tracer *tracing.Tracer) {
+	handler.updateMtx.Lock()
+	defer handler.updateMtx.Unlock()
+	handler.tracer = tracer
+}
+
+// startSpan starts the span of an incoming request, which continues the trace of the caller, e.g., a load balancer of
+// another zone
+func (handler *WeightedRoundRobinHandler) startSpan(req *http.Request, function string) *tracing.Span {
+	if handler.tracer == nil {
+		return nil
+	}
+	span := handler.tracer.StartServer(req, fmt.Sprintf("golb %s", function))
+	span.SetAttribute("golb.function", function)
+	span.SetAttribute("golb.zone", handler.functionState.Zone)
+	if handler.NodeName != "" {
+		span.SetAttribute("golb.node", handler.NodeName)
+	}
+	span.SetAttribute("golb.gateway_hop", isForwarded(req))
+	span.SetAttribute("http.method", req.Method)
+	span.SetAttribute("http.target", req.URL.RequestURI())
+	return span
+}
+
+func endSpan(span *tracing.Span, recorder *statusRecorder) {
+	span.SetAttribute("http.status_code", recorder.status)
+	if recorder.status >= 500 {
+		span.SetError(fmt.Errorf("responded with status %d", recorder.status))
+	}
+	span.End()
+}
+
+// startAttemptSpan starts the span of a request that is sent to a backend, its context is passed to the backend
+func startAttemptSpan(span *tracing.Span, function string, ip string, attempt int) *tracing.Span {
+	attemptSpan := span.StartChild(fmt.Sprintf("golb %s forward", function), tracing.Client)
+	attemptSpan.SetAttribute("golb.backend", ip)
+	attemptSpan.SetAttribute("golb.attempt", attempt)
+	return attemptSpan
+}
+
+func endAttemptSpan(span *tracing.Span, result loadbalancer.Result) {
+	if result.StatusCode != 0 {
+		span.SetAttribute("http.status_code", result.StatusCode)
+	}
+	span.SetError(result.Err)
+	span.End()
+}
@@ -0,0 +1,56 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/tracing"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// spanRecorder keeps the contexts of the exported spans
+type spanRecorder struct {
+	mtx   sync.Mutex
+	spans []tracing.SpanContext
+}
+
+func (recorder *spanRecorder) Export(span *tracing.Span) {
+	recorder.mtx.Lock()
+	defer recorder.mtx.Unlock()
+	recorder.spans = append(recorder.spans, span.Context())
+}
+
+func TestTraceparentIsPropagatedToTheBackend(t *testing.T) {
+	traceparents := make(chan string, 1)
+	backend := newTestBackend(t, func(res http.ResponseWriter, req *http.Request) {
+		traceparents <- req.Header.Get(tracing.TraceparentHeader)
+	})
+	inFlight := &inFlightCounts{counts: make(map[string]int)}
+	handler := newTestHandler(newStickyFactory(inFlight), FunctionPolicy{RetryAttempts: 1},
+		map[string]Weights{"f": {Ips: []string{backend}, Weights: []int{1}}})
+	recorder := &spanRecorder{}
+	handler.Trace(tracing.NewTracer(recorder, 1))
+
+	req := httptest.NewRequest(http.MethodGet, "/function/f/", nil)
+	req.Header.Set(tracing.TraceparentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	res := httptest.NewRecorder()
+	handler.Handle(res, req)
+	if res.Code != http.StatusOK {
+		t.Fatalf("got status %d", res.Code)
+	}
+
+	received, err := tracing.ParseTraceparent(<-traceparents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received.TraceID.String() != "0af7651916cd43dd8448eb211c80319c" || !received.Sampled {
+		t.Errorf("the backend did not continue the trace of the caller: %s", received.Traceparent())
+	}
+	if received.SpanID.String() == "b7ad6b7169203331" {
+		t.Error("the backend received the span of the caller instead of the span of the attempt")
+	}
+	// the attempt ends before the request span
+	if len(recorder.spans) != 2 || recorder.spans[0] != received {
+		t.Errorf("the backend received %s, exported spans are %v", received.Traceparent(), recorder.spans)
+	}
+}
@@ -0,0 +1,423 @@
+package handler
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v2"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type WeightUpdater interface {
+	GetUpdates(string) chan *WeightUpdate
+}
+
+// FunctionStateLoader is implemented by weight updaters that can provide the weights to start with
+type FunctionStateLoader interface {
+	LoadFunctionState(state *FunctionState) error
+}
+
+type WeightUpdaterOptions struct {
+	// Type is etcd, file, http or static
+	Type         string        `yaml:"type"`
+	EtcdHost     string        `yaml:"etcd_host"`
+	File         string        `yaml:"file"`
+	FileInterval time.Duration `yaml:"file_interval"`
+	// ListenHost is the interface the http updater binds, it accepts weights without authentication
+	ListenHost string             `yaml:"listen_host"`
+	ListenPort int                `yaml:"listen_port"`
+	Static     map[string]Weights `yaml:"static"`
+}
+
+func NewDefaultWeightUpdaterOptions() WeightUpdaterOptions {
+	return WeightUpdaterOptions{
+		Type:         "etcd",
+		EtcdHost:     "localhost:2379",
+		FileInterval: time.Second,
+		ListenHost:   "localhost",
+		ListenPort:   8078,
+	}
+}
+
+// ReadWeightUpdaterOptions overrides the options with the variables of the environment
+func ReadWeightUpdaterOptions(environment env.Environment, options WeightUpdaterOptions) (WeightUpdaterOptions, error) {
+	if updaterType, found := environment.Lookup("eb_go_lb_weight_updater"); found {
+		options.Type = strings.ToLower(updaterType)
+	}
+	if host, found := environment.Lookup("eb_go_lb_etcd_host"); found {
+		options.EtcdHost = host
+	}
+	if path, found := environment.Lookup("eb_go_lb_weights_file"); found {
+		options.File = path
+	}
+	if interval, found, err := environment.LookupDuration("eb_go_lb_weights_file_interval"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_weights_file_interval: %s", err)
+		}
+		options.FileInterval = interval
+	}
+	if host, found := environment.Lookup("eb_go_lb_weights_listen_host"); found {
+		options.ListenHost = host
+	}
+	if port, found, err := environment.LookupInt("eb_go_lb_weights_listen_port"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_weights_listen_port: %s", err)
+		}
+		options.ListenPort = int(port)
+	}
+	if value, found := environment.Lookup("eb_go_lb_static_weights"); found {
+		functions, err := parseFunctions([]byte(value), json.Unmarshal)
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_static_weights: %s", err)
+		}
+		options.Static = functions
+	}
+	return options, nil
+}
+
+func (options WeightUpdaterOptions) Validate() error {
+	switch options.Type {
+	case "etcd":
+		if options.EtcdHost == "" {
+			return errors.New("the etcd weight updater requires an etcd host")
+		}
+	case "file":
+		if options.File == "" {
+			return errors.New("the file weight updater requires a file")
+		}
+		if options.FileInterval <= 0 {
+			return errors.New("the file interval must be positive")
+		}
+	case "http":
+		if options.ListenPort < 1 || options.ListenPort > 65535 {
+			return fmt.Errorf("invalid listen port %d", options.ListenPort)
+		}
+	case "static":
+		if options.Static == nil {
+			return errors.New("the static weight updater requires weights")
+		}
+		for function, weights := range options.Static {
+			if err := validateWeights(weights); err != nil {
+				return fmt.Errorf("weights of %s: %s", function, err)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown weight updater '%s', expected etcd, file, http or static", options.Type)
+	}
+	return nil
+}
+
+func NewWeightUpdater(options WeightUpdaterOptions) (WeightUpdater, error) {
+	if err := options.Validate(); err != nil {
+		return nil, err
+	}
+	switch options.Type {
+	case "file":
+		zap.S().Infow("Read weights from file", "path", options.File, "interval", options.FileInterval)
+		return NewFileWeightUpdater(options.File, options.FileInterval), nil
+	case "http":
+		addr := net.JoinHostPort(options.ListenHost, strconv.Itoa(options.ListenPort))
+		zap.S().Infow("Accept weights via HTTP", "addr", addr)
+		updater := NewHttpWeightUpdater(addr)
+		if err := updater.Listen(); err != nil {
+			return nil, fmt.Errorf("error accepting weights via HTTP: %s", err)
+		}
+		return updater, nil
+	case "static":
+		return NewStaticWeightUpdater(options.Static), nil
+	default:
+		zap.S().Infow("Connect to etcd", "etcdUrl", options.EtcdHost)
+		client, err := NewEtcdClient(options.EtcdHost)
+		if err != nil {
+			return nil, err
+		}
+		return NewEtcdWeightUpdater(client), nil
+	}
+}
+
+func validateWeights(weights Weights) error {
+	if len(weights.Ips) != len(weights.Weights) {
+		return fmt.Errorf("got %d ips but %d weights", len(weights.Ips), len(weights.Weights))
+	}
+	if len(weights.Gateways) != 0 && len(weights.Gateways) != len(weights.Ips) {
+		return fmt.Errorf("got %d ips but %d gateway flags", len(weights.Ips), len(weights.Gateways))
+	}
+	if len(weights.Zones) != 0 && len(weights.Zones) != len(weights.Ips) {
+		return fmt.Errorf("got %d ips but %d zones", len(weights.Ips), len(weights.Zones))
+	}
+	if len(weights.Priorities) != 0 && len(weights.Priorities) != len(weights.Ips) {
+		return fmt.Errorf("got %d ips but %d priorities", len(weights.Ips), len(weights.Priorities))
+	}
+	for _, priority := range weights.Priorities {
+		if priority < 0 {
+			return fmt.Errorf("priorities must not be negative, got %d", priority)
+		}
+	}
+	for _, weight := range weights.Weights {
+		if weight < 0 {
+			return fmt.Errorf("weights must not be negative, got %d", weight)
+		}
+	}
+	return nil
+}
+
+// parseFunctions reads an object that maps functions to their weights, e.g., '{"resnet": {"ips": ["10.0.0.1"],
+// "weights": [1]}}'
+func parseFunctions(data []byte, unmarshal func([]byte, interface{}) error) (map[string]Weights, error) {
+	functions := make(map[string]Weights)
+	if err := unmarshal(data, &functions); err != nil {
+		return nil, err
+	}
+	for function, weights := range functions {
+		if err := validateWeights(weights); err != nil {
+			return nil, fmt.Errorf("weights of %s: %s", function, err)
+		}
+	}
+	return functions, nil
+}
+
+// diffFunctions returns the updates that turn the known weights into the current ones
+func diffFunctions(known map[string]Weights, current map[string]Weights) []*WeightUpdate {
+	var updates []*WeightUpdate
+	for function := range known {
+		if _, found := current[function]; !found {
+			zap.S().Debugw("diff delete", "function", function)
+			updates = append(updates, NewFunctionRemoval(function))
+		}
+	}
+	for function, weights := range current {
+		if previous, found := known[function]; !found || !reflect.DeepEqual(previous, weights) {
+			zap.S().Debugw("diff put", "function", function, "weights", weights)
+			updates = append(updates, NewWeightUpdate(function, weights))
+		}
+	}
+	return updates
+}
+
+// StaticWeightUpdater provides a fixed set of weights that never changes
+type StaticWeightUpdater struct {
+	functions map[string]Weights
+}
+
+func NewStaticWeightUpdater(functions map[string]Weights) *StaticWeightUpdater {
+	return &StaticWeightUpdater{
+		functions: functions,
+	}
+}
+
+func (updater *StaticWeightUpdater) LoadFunctionState(state *FunctionState) error {
+	for function, weights := range updater.functions {
+		state.Put(function, weights)
+	}
+	return nil
+}
+
+func (updater *StaticWeightUpdater) GetUpdates(string) chan *WeightUpdate {
+	return make(chan *WeightUpdate)
+}
+
+// FileWeightUpdater reads the weights of all functions from a JSON or YAML file (by extension) and checks the file for
+// changes in the given interval. The file maps functions to their weights, functions that disappear from the file are
+// removed.
+type FileWeightUpdater struct {
+	Path     string
+	Interval time.Duration
+	known    map[string]Weights
+	modTime  time.Time
+	size     int64
+	stop     chan struct{}
+}
+
+func NewFileWeightUpdater(path string, interval time.Duration) *FileWeightUpdater {
+	return &FileWeightUpdater{
+		Path:     path,
+		Interval: interval,
+		known:    make(map[string]Weights),
+		stop:     make(chan struct{}),
+	}
+}
+
+func (updater *FileWeightUpdater) read() (map[string]Weights, error) {
+	info, err := os.Stat(updater.Path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(updater.Path)
+	if err != nil {
+		return nil, err
+	}
+	unmarshal := json.Unmarshal
+	switch strings.ToLower(filepath.Ext(updater.Path)) {
+	case ".yaml", ".yml":
+		unmarshal = yaml.Unmarshal
+	}
+	functions, err := parseFunctions(data, unmarshal)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", updater.Path, err)
+	}
+	updater.modTime = info.ModTime()
+	updater.size = info.Size()
+	return functions, nil
+}
+
+func (updater *FileWeightUpdater) changed() bool {
+	info, err := os.Stat(updater.Path)
+	if err != nil {
+		zap.S().Errorf("error checking weights file: %s", err)
+		return false
+	}
+	return !info.ModTime().Equal(updater.modTime) || info.Size() != updater.size
+}
+
+func (updater *FileWeightUpdater) LoadFunctionState(state *FunctionState) error {
+	functions, err := updater.read()
+	if err != nil {
+		return err
+	}
+	for function, weights := range functions {
+		state.Put(function, weights)
+	}
+	updater.known = functions
+	return nil
+}
+
+func (updater *FileWeightUpdater) GetUpdates(string) chan *WeightUpdate {
+	updates := make(chan *WeightUpdate)
+	go func() {
+		defer close(updates)
+		ticker := time.NewTicker(updater.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-updater.stop:
+				return
+			}
+			if !updater.changed() {
+				continue
+			}
+			functions, err := updater.read()
+			if err != nil {
+				// keep the previous weights until the file is valid again
+				zap.S().Errorf("error reading weights file: %s", err)
+				continue
+			}
+			for _, update := range diffFunctions(updater.known, functions) {
+				updates <- update
+			}
+			updater.known = functions
+		}
+	}()
+	return updates
+}
+
+// Close stops checking the file, the channel returned by GetUpdates is closed afterwards
+func (updater *FileWeightUpdater) Close() error {
+	close(updater.stop)
+	return nil
+}
+
+// HttpWeightUpdater accepts weights that are pushed with 'PUT /weights/<function>' and removes functions with
+// 'DELETE /weights/<function>'. The weights are not persisted, so they have to be pushed again after a restart.
+type HttpWeightUpdater struct {
+	Addr    string
+	updates chan *WeightUpdate
+	server  *http.Server
+	closed  chan struct{}
+	close   sync.Once
+}
+
+func NewHttpWeightUpdater(addr string) *HttpWeightUpdater {
+	return &HttpWeightUpdater{
+		Addr:    addr,
+		updates: make(chan *WeightUpdate),
+		closed:  make(chan struct{}),
+	}
+}
+
+// Listen binds the address and accepts weights in the background, it returns an error if the address is not available
+func (updater *HttpWeightUpdater) Listen() error {
+	listener, err := net.Listen("tcp", updater.Addr)
+	if err != nil {
+		return err
+	}
+	// the address the system has chosen, if the port is 0
+	updater.Addr = listener.Addr().String()
+	mux := http.NewServeMux()
+	mux.Handle("/weights/", updater)
+	updater.server = &http.Server{
+		Handler: mux,
+	}
+	go func() {
+		if err := updater.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			zap.S().Errorf("error accepting weights on %s: %s", updater.Addr, err)
+		}
+	}()
+	return nil
+}
+
+// GetUpdates returns the pushed weights, they are only accepted once Listen has been called
+func (updater *HttpWeightUpdater) GetUpdates(string) chan *WeightUpdate {
+	return updater.updates
+}
+
+// Close stops accepting weights, the channel returned by GetUpdates stays open
+func (updater *HttpWeightUpdater) Close() error {
+	updater.close.Do(func() {
+		close(updater.closed)
+	})
+	if updater.server == nil {
+		return nil
+	}
+	return updater.server.Close()
+}
+
+func (updater *HttpWeightUpdater) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	function := strings.TrimPrefix(req.URL.Path, "/weights/")
+	if function == "" || strings.Contains(function, "/") {
+		http.Error(res, "expected /weights/<function>", http.StatusNotFound)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodPut:
+		weights := Weights{}
+		if err := json.NewDecoder(req.Body).Decode(&weights); err != nil {
+			http.Error(res, fmt.Sprintf("error parsing weights: %s", err), http.StatusBadRequest)
+			return
+		}
+		if err := validateWeights(weights); err != nil {
+			http.Error(res, err.Error(), http.StatusBadRequest)
+			return
+		}
+		updater.send(res, req, NewWeightUpdate(function, weights))
+	case http.MethodDelete:
+		updater.send(res, req, NewFunctionRemoval(function))
+	default:
+		res.Header().Set("Allow", "PUT, DELETE")
+		http.Error(res, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// send passes the update on and answers with 503 if nobody receives it before the request is canceled or the updater
+// is closed
+func (updater *HttpWeightUpdater) send(res http.ResponseWriter, req *http.Request, update *WeightUpdate) {
+	select {
+	case updater.updates <- update:
+		res.WriteHeader(http.StatusNoContent)
+	case <-updater.closed:
+		http.Error(res, "not accepting weights", http.StatusServiceUnavailable)
+	case <-req.Context().Done():
+		http.Error(res, "weights were not applied in time", http.StatusServiceUnavailable)
+	}
+}
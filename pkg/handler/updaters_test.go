@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpWeightUpdaterListenFails(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	updater := NewHttpWeightUpdater(listener.Addr().String())
+	if err := updater.Listen(); err == nil {
+		updater.Close()
+		t.Fatal("expected an error for an address in use")
+	}
+}
+
+func TestHttpWeightUpdater(t *testing.T) {
+	updater := NewHttpWeightUpdater("127.0.0.1:0")
+	if err := updater.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	defer updater.Close()
+	updates := updater.GetUpdates("")
+	addr := "http://" + updater.Addr
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		update string
+	}{
+		{"put", http.MethodPut, "/weights/f", `{"ips": ["10.0.0.1"], "weights": [1]}`, http.StatusNoContent, "put f"},
+		{"delete", http.MethodDelete, "/weights/f", "", http.StatusNoContent, "delete f"},
+		{"invalid weights", http.MethodPut, "/weights/f", `{"ips": ["10.0.0.1"], "weights": [-1]}`, http.StatusBadRequest, ""},
+		{"not json", http.MethodPut, "/weights/f", "weights", http.StatusBadRequest, ""},
+		{"missing function", http.MethodPut, "/weights/", "{}", http.StatusNotFound, ""},
+		{"method not allowed", http.MethodPost, "/weights/f", "{}", http.StatusMethodNotAllowed, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			received := make(chan string, 1)
+			go func() {
+				select {
+				case update := <-updates:
+					received <- describeUpdates([]*WeightUpdate{update})[0]
+				case <-time.After(100 * time.Millisecond):
+					received <- ""
+				}
+			}()
+			req, _ := http.NewRequest(test.method, addr+test.path, strings.NewReader(test.body))
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.status {
+				t.Errorf("got status %d, expected %d", resp.StatusCode, test.status)
+			}
+			if update := <-received; update != test.update {
+				t.Errorf("got update '%s', expected '%s'", update, test.update)
+			}
+		})
+	}
+}
+
+func TestHttpWeightUpdaterWithoutReceiver(t *testing.T) {
+	updater := NewHttpWeightUpdater("127.0.0.1:0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest(http.MethodDelete, "/weights/f", nil).WithContext(ctx)
+	res := httptest.NewRecorder()
+	updater.ServeHTTP(res, req)
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for a canceled request, expected 503", res.Code)
+	}
+
+	updater.Close()
+	res = httptest.NewRecorder()
+	updater.ServeHTTP(res, httptest.NewRequest(http.MethodDelete, "/weights/f", nil))
+	if res.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d after close, expected 503", res.Code)
+	}
+}
+
+func TestHttpWeightUpdaterListensOnLocalhost(t *testing.T) {
+	options := NewDefaultWeightUpdaterOptions()
+	options.Type = "http"
+	options.ListenPort = freePort(t)
+	updater, err := NewWeightUpdater(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer updater.(*HttpWeightUpdater).Close()
+	host, _, _ := net.SplitHostPort(updater.(*HttpWeightUpdater).Addr)
+	if ip := net.ParseIP(host); ip == nil || !ip.IsLoopback() {
+		t.Errorf("listens on %s, expected a loopback address", host)
+	}
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
@@ -0,0 +1,199 @@
+package loadbalancer
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultHashVirtualNodes = 40
+
+// HashKey extracts the key that is used to select a backend on the hash ring
+type HashKey func(req *http.Request) string
+
+// NewHashKey parses key definitions of the form 'header:<name>', 'query:<name>', 'cookie:<name>' or 'path'. The latter
+// uses the path after '/function/<function>'.
+func NewHashKey(definition string) (HashKey, error) {
+	if definition == "path" {
+		return pathSuffixKey, nil
+	}
+
+	split := strings.SplitN(definition, ":", 2)
+	if len(split) != 2 || split[1] == "" {
+		return nil, fmt.Errorf("invalid hash key '%s', expected one of header:<name>, query:<name>, cookie:<name> or path", definition)
+	}
+
+	name := split[1]
+	switch split[0] {
+	case "header":
+		return func(req *http.Request) string {
+			return req.Header.Get(name)
+		}, nil
+	case "query":
+		return func(req *http.Request) string {
+			return req.URL.Query().Get(name)
+		}, nil
+	case "cookie":
+		return func(req *http.Request) string {
+			cookie, err := req.Cookie(name)
+			if err != nil {
+				return ""
+			}
+			return cookie.Value
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown hash key source '%s'", split[0])
+	}
+}
+
+func pathSuffixKey(req *http.Request) string {
+	split := strings.SplitN(req.URL.Path, "/", 4)
+	if len(split) < 4 {
+		return ""
+	}
+	return split[3]
+}
+
+// hashRing is a consistent hash ring. Every backend is placed on the ring with a number of virtual nodes proportional
+// to its weight. The positions only depend on the ip, therefore membership changes only move the keys of the backends
+// that have been added or removed.
+type hashRing struct {
+	hashes []uint64
+	owners map[uint64]string
+}
+
+// hashString hashes with FNV-1a and mixes the result with the finalizer of MurmurHash3, because FNV alone places
+// similar strings like the virtual nodes of a backend close to each other on the ring
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func newHashRing(weights Weights, virtualNodes int) (*hashRing, error) {
+	ring := &hashRing{
+		owners: make(map[uint64]string),
+	}
+	for i, ip := range weights.Ips {
+		for n := 0; n < weights.Weights[i]*virtualNodes; n++ {
+			h := hashString(ip + "#" + strconv.Itoa(n))
+			if _, taken := ring.owners[h]; taken {
+				continue
+			}
+			ring.owners[h] = ip
+			ring.hashes = append(ring.hashes, h)
+		}
+	}
+	if len(ring.hashes) == 0 {
+		return nil, errors.New("cannot build hash ring without weighted servers")
+	}
+	sort.Slice(ring.hashes, func(i, j int) bool {
+		return ring.hashes[i] < ring.hashes[j]
+	})
+	return ring, nil
+}
+
+func (ring *hashRing) get(key string) string {
+	h := hashString(key)
+	i := sort.Search(len(ring.hashes), func(i int) bool {
+		return ring.hashes[i] >= h
+	})
+	if i == len(ring.hashes) {
+		i = 0
+	}
+	return ring.owners[ring.hashes[i]]
+}
+
+// ConsistentHash routes requests with the same key to the same backend, e.g., to benefit from per-model caches.
+// Requests without a key are hashed by the address of the client.
+type ConsistentHash struct {
+	ring *hashRing
+	key  HashKey
+}
+
+func NewConsistentHashFactory(key HashKey, virtualNodes int) Factory {
+	return func(weights Weights, _ LoadBalancingStrategy) (LoadBalancingStrategy, error) {
+		ring, err := newHashRing(weights, virtualNodes)
+		if err != nil {
+			return nil, err
+		}
+		return &ConsistentHash{
+			ring: ring,
+			key:  key,
+		}, nil
+	}
+}
+
+func readHashKey(environment env.Environment) (HashKey, error) {
+	definition, found := environment.Lookup("eb_go_lb_hash_key")
+	if !found {
+		definition = "path"
+	}
+	return NewHashKey(definition)
+}
+
+func readHashVirtualNodes(environment env.Environment) (int, error) {
+	virtualNodes, found, err := environment.LookupInt("eb_go_lb_hash_vnodes")
+	if !found {
+		return defaultHashVirtualNodes, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if virtualNodes <= 0 {
+		return 0, fmt.Errorf("eb_go_lb_hash_vnodes must be positive: %d", virtualNodes)
+	}
+	return int(virtualNodes), nil
+}
+
+func (ch *ConsistentHash) Select(req *http.Request) (string, error) {
+	key := ch.key(req)
+	if key == "" {
+		key, _, _ = net.SplitHostPort(req.RemoteAddr)
+	}
+	return ch.ring.get(key), nil
+}
+
+func (ch *ConsistentHash) Done(string, Result) {
+}
+
+// ConsistentHashState contains the number of virtual nodes of every backend on the ring
+type ConsistentHashState struct {
+	VirtualNodes map[string]int `json:"virtual_nodes"`
+}
+
+func (ch *ConsistentHash) Inspect() interface{} {
+	virtualNodes := make(map[string]int)
+	for _, ip := range ch.ring.owners {
+		virtualNodes[ip]++
+	}
+	return ConsistentHashState{
+		VirtualNodes: virtualNodes,
+	}
+}
+
+func init() {
+	Register("hash", func(environment env.Environment) (Factory, error) {
+		key, err := readHashKey(environment)
+		if err != nil {
+			return nil, err
+		}
+		virtualNodes, err := readHashVirtualNodes(environment)
+		if err != nil {
+			return nil, err
+		}
+		return NewConsistentHashFactory(key, virtualNodes), nil
+	})
+}
@@ -0,0 +1,148 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewHashKey(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/function/resnet/predict/1?user=q", nil)
+	req.Header.Set("X-User", "h")
+	req.AddCookie(&http.Cookie{Name: "session", Value: "c"})
+	tests := []struct {
+		definition string
+		expect     string
+		err        bool
+	}{
+		{"path", "predict/1", false},
+		{"header:X-User", "h", false},
+		{"query:user", "q", false},
+		{"cookie:session", "c", false},
+		{"cookie:missing", "", false},
+		{"header:", "", true},
+		{"body:x", "", true},
+		{"path:x", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.definition, func(t *testing.T) {
+			key, err := NewHashKey(test.definition)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if value := key(req); value != test.expect {
+				t.Errorf("got key '%s', expected '%s'", value, test.expect)
+			}
+		})
+	}
+}
+
+func selectAll(t *testing.T, strategy LoadBalancingStrategy, keys int) map[string]string {
+	selected := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/function/f/", nil)
+		req.Header.Set("X-Key", fmt.Sprint(i))
+		ip, err := strategy.Select(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selected[fmt.Sprint(i)] = ip
+	}
+	return selected
+}
+
+func TestConsistentHashRing(t *testing.T) {
+	key, _ := NewHashKey("header:X-Key")
+	factory := NewConsistentHashFactory(key, defaultHashVirtualNodes)
+	// only keys of a removed backend and keys taken over by an added backend may move
+	tests := []struct {
+		name   string
+		before Weights
+		after  Weights
+		moves  func(from string, to string) bool
+	}{
+		{"backend added", Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}}, Weights{Ips: []string{"a", "b", "c"}, Weights: []int{1, 1, 1}},
+			func(_ string, to string) bool { return to == "c" }},
+		{"backend removed", Weights{Ips: []string{"a", "b", "c"}, Weights: []int{1, 1, 1}}, Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}},
+			func(from string, _ string) bool { return from == "c" }},
+		{"weights unchanged", Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}}, Weights{Ips: []string{"b", "a"}, Weights: []int{1, 1}},
+			func(string, string) bool { return false }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before, err := factory(test.before, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after, err := factory(test.after, before)
+			if err != nil {
+				t.Fatal(err)
+			}
+			selectedBefore := selectAll(t, before, 1000)
+			selectedAfter := selectAll(t, after, 1000)
+			moved := 0
+			for key, from := range selectedBefore {
+				if to := selectedAfter[key]; to != from {
+					moved++
+					if !test.moves(from, to) {
+						t.Errorf("key %s moved from %s to %s", key, from, to)
+					}
+				}
+			}
+			if moved == 0 && len(test.before.Ips) != len(test.after.Ips) {
+				t.Error("no key moved")
+			}
+		})
+	}
+}
+
+func TestConsistentHashWeights(t *testing.T) {
+	key, _ := NewHashKey("header:X-Key")
+	strategy, err := NewConsistentHashFactory(key, defaultHashVirtualNodes)(Weights{Ips: []string{"a", "b", "c"}, Weights: []int{3, 1, 0}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := make(map[string]int)
+	for _, ip := range selectAll(t, strategy, 4000) {
+		counts[ip]++
+	}
+	if counts["c"] != 0 {
+		t.Errorf("backend with weight 0 got %d keys", counts["c"])
+	}
+	if counts["a"] < 2*counts["b"] {
+		t.Errorf("expected about three times as many keys for a as for b, got %v", counts)
+	}
+	state := strategy.(*ConsistentHash).Inspect().(ConsistentHashState)
+	if state.VirtualNodes["a"] != 3*defaultHashVirtualNodes || state.VirtualNodes["b"] != defaultHashVirtualNodes {
+		t.Errorf("unexpected virtual nodes %v", state.VirtualNodes)
+	}
+}
+
+func TestConsistentHashFallsBackToClientAddress(t *testing.T) {
+	key, _ := NewHashKey("header:X-Key")
+	strategy, _ := NewConsistentHashFactory(key, defaultHashVirtualNodes)(Weights{Ips: []string{"a", "b", "c"}, Weights: []int{1, 1, 1}}, nil)
+	selected := make(map[string]bool)
+	for i := 0; i < 10; i++ {
+		req := httptest.NewRequest(http.MethodGet, "/function/f/", nil)
+		req.RemoteAddr = fmt.Sprintf("192.0.2.1:%d", 1000+i)
+		ip, _ := strategy.Select(req)
+		selected[ip] = true
+	}
+	if len(selected) != 1 {
+		t.Errorf("requests of the same client address were spread over %v", selected)
+	}
+}
+
+func TestConsistentHashWithoutWeightedServers(t *testing.T) {
+	key, _ := NewHashKey("path")
+	if _, err := NewConsistentHashFactory(key, 1)(Weights{Ips: []string{"a"}, Weights: []int{0}}, nil); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,97 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// inFlightCounter counts the outstanding requests per backend ip. It is shared between the strategy instances of a
+// function, so the counts survive weight updates.
+type inFlightCounter struct {
+	mtx    sync.Mutex
+	counts map[string]int
+}
+
+// LeastRequests selects the backend with the fewest outstanding requests. The weights scale the number of requests a
+// backend is expected to handle, i.e., a backend with weight 2 is considered as busy as a backend with weight 1 once it
+// has twice as many requests in flight. Ties are broken in favour of the higher weight.
+type LeastRequests struct {
+	weights  Weights
+	inFlight *inFlightCounter
+}
+
+func NewLeastRequests(weights Weights, previous LoadBalancingStrategy) (LoadBalancingStrategy, error) {
+	if len(weights.Ips) == 0 {
+		return nil, errors.New("cannot create least requests strategy without servers")
+	}
+	strategy := &LeastRequests{
+		weights: weights,
+	}
+	if lr, ok := previous.(*LeastRequests); ok {
+		strategy.inFlight = lr.inFlight
+	} else {
+		strategy.inFlight = &inFlightCounter{
+			counts: make(map[string]int),
+		}
+	}
+	return strategy, nil
+}
+
+func (lr *LeastRequests) Select(*http.Request) (string, error) {
+	lr.inFlight.mtx.Lock()
+	defer lr.inFlight.mtx.Unlock()
+
+	selected := -1
+	var selectedLoad float64
+	for i, ip := range lr.weights.Ips {
+		weight := lr.weights.Weights[i]
+		if weight <= 0 {
+			continue
+		}
+		load := float64(lr.inFlight.counts[ip]+1) / float64(weight)
+		if selected == -1 || load < selectedLoad || (load == selectedLoad && weight > lr.weights.Weights[selected]) {
+			selected = i
+			selectedLoad = load
+		}
+	}
+
+	if selected == -1 {
+		return "", errors.New("no server with positive weight")
+	}
+
+	ip := lr.weights.Ips[selected]
+	lr.inFlight.counts[ip]++
+	return ip, nil
+}
+
+func (lr *LeastRequests) Done(ip string, _ Result) {
+	lr.inFlight.mtx.Lock()
+	defer lr.inFlight.mtx.Unlock()
+	lr.inFlight.counts[ip]--
+	if lr.inFlight.counts[ip] <= 0 {
+		delete(lr.inFlight.counts, ip)
+	}
+}
+
+type LeastRequestsState struct {
+	Weights  Weights        `json:"weights"`
+	InFlight map[string]int `json:"in_flight"`
+}
+
+func (lr *LeastRequests) Inspect() interface{} {
+	lr.inFlight.mtx.Lock()
+	defer lr.inFlight.mtx.Unlock()
+	inFlight := make(map[string]int, len(lr.inFlight.counts))
+	for ip, count := range lr.inFlight.counts {
+		inFlight[ip] = count
+	}
+	return LeastRequestsState{
+		Weights:  lr.weights,
+		InFlight: inFlight,
+	}
+}
+
+func init() {
+	Register("least", staticBuilder(NewLeastRequests))
+}
@@ -0,0 +1,62 @@
+package loadbalancer
+
+import (
+	"testing"
+)
+
+func TestLeastRequestsSelect(t *testing.T) {
+	tests := []struct {
+		name     string
+		weights  Weights
+		inFlight map[string]int
+		expect   string
+	}{
+		{"fewest in flight", Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}}, map[string]int{"a": 2, "b": 1}, "b"},
+		{"tie prefers higher weight", Weights{Ips: []string{"a", "b"}, Weights: []int{1, 2}}, map[string]int{"a": 1, "b": 3}, "b"},
+		{"weights scale load", Weights{Ips: []string{"a", "b"}, Weights: []int{1, 3}}, map[string]int{"a": 1, "b": 3}, "b"},
+		{"zero weight is skipped", Weights{Ips: []string{"a", "b"}, Weights: []int{0, 1}}, map[string]int{"b": 10}, "b"},
+		{"first on equal load", Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}}, nil, "a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			strategy, err := NewLeastRequests(test.weights, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for ip, count := range test.inFlight {
+				strategy.(*LeastRequests).inFlight.counts[ip] = count
+			}
+			ip, err := strategy.Select(nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ip != test.expect {
+				t.Errorf("selected %s, expected %s", ip, test.expect)
+			}
+		})
+	}
+}
+
+func TestLeastRequestsCountsSurviveUpdates(t *testing.T) {
+	weights := Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}}
+	first, _ := NewLeastRequests(weights, nil)
+	ip, _ := first.Select(nil)
+	second, _ := NewLeastRequests(weights, first)
+	if other, _ := second.Select(nil); other == ip {
+		t.Errorf("selected %s twice although it has a request in flight", ip)
+	}
+	second.Done(ip, Result{StatusCode: 200})
+	if counts := second.(*LeastRequests).Inspect().(LeastRequestsState).InFlight; counts[ip] != 0 {
+		t.Errorf("expected no requests in flight on %s, got %d", ip, counts[ip])
+	}
+}
+
+func TestLeastRequestsWithoutServers(t *testing.T) {
+	if _, err := NewLeastRequests(Weights{}, nil); err == nil {
+		t.Error("expected an error without servers")
+	}
+	strategy, _ := NewLeastRequests(Weights{Ips: []string{"a"}, Weights: []int{0}}, nil)
+	if _, err := strategy.Select(nil); err == nil {
+		t.Error("expected an error without weighted servers")
+	}
+}
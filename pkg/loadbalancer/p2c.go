@@ -0,0 +1,218 @@
+package loadbalancer
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultEwmaDecay = 10 * time.Second
+	// failurePenalty multiplies the latency of failed requests, so that backends that fail fast are not preferred
+	failurePenalty = 5
+	// minFailureLatency is the latency that is recorded at least for a failed request
+	minFailureLatency = time.Second
+)
+
+// ewma is an exponentially weighted moving average of the observed latency. Older observations decay with the time
+// that passed since the last observation, so a backend that has not been chosen for a while converges quickly.
+type ewma struct {
+	value float64
+	last  time.Time
+}
+
+func (e *ewma) observe(latency time.Duration, now time.Time, decay time.Duration) {
+	if e.last.IsZero() {
+		e.value = float64(latency)
+		e.last = now
+		return
+	}
+	w := math.Exp(-float64(now.Sub(e.last)) / float64(decay))
+	e.value = e.value*w + float64(latency)*(1-w)
+	e.last = now
+}
+
+// latencyTracker holds the averages per backend ip and is shared between the strategy instances of a function
+type latencyTracker struct {
+	mtx       sync.Mutex
+	decay     time.Duration
+	latencies map[string]*ewma
+	rnd       *rand.Rand
+}
+
+// update applies the decay of a reloaded configuration and drops the averages of the backends that are gone
+func (tracker *latencyTracker) update(decay time.Duration, ips []string) {
+	tracker.mtx.Lock()
+	defer tracker.mtx.Unlock()
+	tracker.decay = decay
+	current := make(map[string]bool, len(ips))
+	for _, ip := range ips {
+		current[ip] = true
+	}
+	for ip := range tracker.latencies {
+		if !current[ip] {
+			delete(tracker.latencies, ip)
+		}
+	}
+}
+
+// PowerOfTwoChoices samples two backends proportional to their weights and selects the one with the lower moving
+// average of the observed response latency.
+type PowerOfTwoChoices struct {
+	weights Weights
+	total   int
+	tracker *latencyTracker
+}
+
+func NewPowerOfTwoChoicesFactory(decay time.Duration) Factory {
+	return func(weights Weights, previous LoadBalancingStrategy) (LoadBalancingStrategy, error) {
+		total := 0
+		for _, weight := range weights.Weights {
+			if weight > 0 {
+				total += weight
+			}
+		}
+		if total == 0 {
+			return nil, errors.New("cannot create p2c strategy without weighted servers")
+		}
+
+		strategy := &PowerOfTwoChoices{
+			weights: weights,
+			total:   total,
+		}
+		if p2c, ok := previous.(*PowerOfTwoChoices); ok {
+			strategy.tracker = p2c.tracker
+			strategy.tracker.update(decay, weights.Ips)
+		} else {
+			strategy.tracker = &latencyTracker{
+				decay:     decay,
+				latencies: make(map[string]*ewma),
+				rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+			}
+		}
+		return strategy, nil
+	}
+}
+
+func readEwmaDecay(environment env.Environment) (time.Duration, error) {
+	decay, found, err := environment.LookupDuration("eb_go_lb_ewma_decay")
+	if !found {
+		return defaultEwmaDecay, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if decay <= 0 {
+		return 0, fmt.Errorf("eb_go_lb_ewma_decay must be positive: %s", decay)
+	}
+	return decay, nil
+}
+
+// sample draws an index proportional to the weights, skipping the given index
+func (p2c *PowerOfTwoChoices) sample(skip int) int {
+	total := p2c.total
+	if skip >= 0 {
+		total -= p2c.weights.Weights[skip]
+	}
+	r := p2c.tracker.rnd.Intn(total)
+	for i, weight := range p2c.weights.Weights {
+		if i == skip || weight <= 0 {
+			continue
+		}
+		if r < weight {
+			return i
+		}
+		r -= weight
+	}
+	return -1
+}
+
+func (p2c *PowerOfTwoChoices) Select(*http.Request) (string, error) {
+	p2c.tracker.mtx.Lock()
+	defer p2c.tracker.mtx.Unlock()
+
+	first := p2c.sample(-1)
+	if p2c.weights.Weights[first] == p2c.total {
+		return p2c.weights.Ips[first], nil
+	}
+	second := p2c.sample(first)
+
+	a, b := p2c.weights.Ips[first], p2c.weights.Ips[second]
+	if p2c.latency(b) < p2c.latency(a) {
+		return b, nil
+	}
+	return a, nil
+}
+
+// latency returns the current average for the ip. Backends without observations are preferred to get measured.
+func (p2c *PowerOfTwoChoices) latency(ip string) float64 {
+	if e, found := p2c.tracker.latencies[ip]; found {
+		return e.value
+	}
+	return 0
+}
+
+func (p2c *PowerOfTwoChoices) Done(ip string, result Result) {
+	if errors.Is(result.Err, ErrSkipped) {
+		return
+	}
+	p2c.tracker.mtx.Lock()
+	defer p2c.tracker.mtx.Unlock()
+	e, found := p2c.tracker.latencies[ip]
+	if !found {
+		e = &ewma{}
+		p2c.tracker.latencies[ip] = e
+	}
+	latency := result.Duration
+	if result.Err != nil || result.StatusCode >= 500 {
+		latency = failureLatency(latency, e)
+	}
+	e.observe(latency, time.Now(), p2c.tracker.decay)
+}
+
+// failureLatency returns the penalty latency of a failed request: a multiple of the observed latency or of the
+// average, whichever is larger, but at least minFailureLatency
+func failureLatency(latency time.Duration, e *ewma) time.Duration {
+	if average := time.Duration(e.value); average > latency {
+		latency = average
+	}
+	latency *= failurePenalty
+	if latency < minFailureLatency {
+		latency = minFailureLatency
+	}
+	return latency
+}
+
+// PowerOfTwoChoicesState contains the moving averages of the latencies in milliseconds
+type PowerOfTwoChoicesState struct {
+	Weights   Weights            `json:"weights"`
+	Latencies map[string]float64 `json:"latencies_ms"`
+}
+
+func (p2c *PowerOfTwoChoices) Inspect() interface{} {
+	p2c.tracker.mtx.Lock()
+	defer p2c.tracker.mtx.Unlock()
+	latencies := make(map[string]float64, len(p2c.tracker.latencies))
+	for ip, e := range p2c.tracker.latencies {
+		latencies[ip] = e.value / float64(time.Millisecond)
+	}
+	return PowerOfTwoChoicesState{
+		Weights:   p2c.weights,
+		Latencies: latencies,
+	}
+}
+
+func init() {
+	Register("p2c", func(environment env.Environment) (Factory, error) {
+		decay, err := readEwmaDecay(environment)
+		if err != nil {
+			return nil, err
+		}
+		return NewPowerOfTwoChoicesFactory(decay), nil
+	})
+}
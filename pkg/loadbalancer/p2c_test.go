@@ -0,0 +1,109 @@
+package loadbalancer
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPowerOfTwoChoicesPrefersLowerLatency(t *testing.T) {
+	tests := []struct {
+		name   string
+		a      Result
+		b      Result
+		expect string
+	}{
+		{"faster backend", Result{StatusCode: 200, Duration: 10 * time.Millisecond}, Result{StatusCode: 200, Duration: 100 * time.Millisecond}, "a"},
+		{"connection refused", Result{Err: errors.New("connection refused"), Duration: time.Millisecond}, Result{StatusCode: 200, Duration: 100 * time.Millisecond}, "b"},
+		{"server error", Result{StatusCode: 503, Duration: time.Millisecond}, Result{StatusCode: 200, Duration: 100 * time.Millisecond}, "b"},
+		{"client error is a success", Result{StatusCode: 404, Duration: time.Millisecond}, Result{StatusCode: 200, Duration: 100 * time.Millisecond}, "a"},
+		{"skipped is ignored", Result{Err: ErrSkipped, Duration: time.Hour}, Result{StatusCode: 200, Duration: 100 * time.Millisecond}, "a"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			strategy, err := NewPowerOfTwoChoicesFactory(time.Second)(Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			strategy.Done("a", test.a)
+			strategy.Done("b", test.b)
+			for i := 0; i < 20; i++ {
+				ip, err := strategy.Select(nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ip != test.expect {
+					t.Fatalf("selected %s, expected %s", ip, test.expect)
+				}
+			}
+		})
+	}
+}
+
+func TestFailureLatency(t *testing.T) {
+	tests := []struct {
+		name    string
+		latency time.Duration
+		average time.Duration
+		expect  time.Duration
+	}{
+		{"fast failure", time.Millisecond, 0, minFailureLatency},
+		{"slow failure", 2 * time.Second, 0, 10 * time.Second},
+		{"average above latency", time.Millisecond, 400 * time.Millisecond, 2 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if latency := failureLatency(test.latency, &ewma{value: float64(test.average)}); latency != test.expect {
+				t.Errorf("got %s, expected %s", latency, test.expect)
+			}
+		})
+	}
+}
+
+func TestPowerOfTwoChoicesKeepsLatenciesOnUpdate(t *testing.T) {
+	factory := NewPowerOfTwoChoicesFactory(time.Second)
+	first, _ := factory(Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}}, nil)
+	first.Done("a", Result{StatusCode: 200, Duration: time.Second})
+	second, err := factory(Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}}, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, _ := second.Select(nil); ip != "b" {
+		t.Errorf("selected %s, expected the unmeasured backend b", ip)
+	}
+}
+
+func TestPowerOfTwoChoicesPrunesRemovedBackends(t *testing.T) {
+	factory := NewPowerOfTwoChoicesFactory(time.Second)
+	first, _ := factory(Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}}, nil)
+	first.Done("a", Result{StatusCode: 200, Duration: time.Second})
+	first.Done("b", Result{StatusCode: 200, Duration: time.Second})
+	second, err := factory(Weights{Ips: []string{"b", "c"}, Weights: []int{1, 1}}, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	latencies := second.(Inspector).Inspect().(PowerOfTwoChoicesState).Latencies
+	if _, found := latencies["a"]; found {
+		t.Error("the latency of the removed backend a is kept")
+	}
+	if _, found := latencies["b"]; !found {
+		t.Error("the latency of b has been dropped")
+	}
+}
+
+func TestPowerOfTwoChoicesAppliesNewDecay(t *testing.T) {
+	weights := Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}}
+	first, _ := NewPowerOfTwoChoicesFactory(time.Second)(weights, nil)
+	first.Done("a", Result{StatusCode: 200, Duration: time.Second})
+	// a reload builds a new factory with the changed decay
+	second, err := NewPowerOfTwoChoicesFactory(time.Minute)(weights, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decay := second.(*PowerOfTwoChoices).tracker.decay; decay != time.Minute {
+		t.Errorf("decay is %s after the reload, expected 1m", decay)
+	}
+	if latencies := second.(Inspector).Inspect().(PowerOfTwoChoicesState).Latencies; len(latencies) != 1 {
+		t.Errorf("latencies are %v, expected the one of a to be kept", latencies)
+	}
+}
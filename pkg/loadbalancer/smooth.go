@@ -0,0 +1,102 @@
+package loadbalancer
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+)
+
+// SmoothWRR implements the smooth weighted round-robin algorithm of nginx
+// (https://github.com/nginx/nginx/commit/52327e0627f49dbda1e8db695e63a4b0af4448b1). In contrast to WRR, the servers
+// are interleaved, e.g., weights [5,1,1] yield AABACAA instead of AAAAABC.
+type SmoothWRR struct {
+	servers []string
+	weights []int
+	mtx     sync.Mutex
+	current []int
+	total   int
+}
+
+// NewSmoothWRR creates a new instance that continues with the current weights of previous for servers that are part of
+// both instances. previous may be nil.
+func NewSmoothWRR(weights Weights, previous *SmoothWRR) (*SmoothWRR, error) {
+	wrr := SmoothWRR{
+		mtx: sync.Mutex{},
+	}
+	for i := range weights.Ips {
+		if weights.Weights[i] <= 0 {
+			continue
+		}
+		wrr.servers = append(wrr.servers, weights.Ips[i])
+		wrr.weights = append(wrr.weights, weights.Weights[i])
+		wrr.total += weights.Weights[i]
+	}
+	if wrr.total == 0 {
+		return &wrr, errors.New("cannot create smooth wrr without weighted servers")
+	}
+
+	wrr.current = make([]int, len(wrr.servers))
+	if previous != nil {
+		previous.mtx.Lock()
+		defer previous.mtx.Unlock()
+		for i, server := range wrr.servers {
+			for j, previousServer := range previous.servers {
+				if server == previousServer {
+					wrr.current[i] = previous.current[j]
+					break
+				}
+			}
+		}
+	}
+	return &wrr, nil
+}
+
+func (w *SmoothWRR) Next() string {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	best := 0
+	for i := range w.servers {
+		w.current[i] += w.weights[i]
+		if w.current[i] > w.current[best] {
+			best = i
+		}
+	}
+	w.current[best] -= w.total
+	return w.servers[best]
+}
+
+func (w *SmoothWRR) Select(*http.Request) (string, error) {
+	return w.Next(), nil
+}
+
+func (w *SmoothWRR) Done(string, Result) {
+}
+
+// SmoothWRRState is the state of a SmoothWRR, the server with the highest current weight is selected next
+type SmoothWRRState struct {
+	Servers []string `json:"servers"`
+	Weights []int    `json:"weights"`
+	Current []int    `json:"current"`
+	Total   int      `json:"total"`
+}
+
+func (w *SmoothWRR) Inspect() interface{} {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return SmoothWRRState{
+		Servers: append([]string(nil), w.servers...),
+		Weights: append([]int(nil), w.weights...),
+		Current: append([]int(nil), w.current...),
+		Total:   w.total,
+	}
+}
+
+// NewSmoothWRRStrategy is the Factory of the smooth weighted round-robin strategy
+func NewSmoothWRRStrategy(weights Weights, previous LoadBalancingStrategy) (LoadBalancingStrategy, error) {
+	wrr, _ := previous.(*SmoothWRR)
+	return NewSmoothWRR(weights, wrr)
+}
+
+func init() {
+	Register("wrr", staticBuilder(NewSmoothWRRStrategy))
+}
@@ -0,0 +1,67 @@
+package loadbalancer
+
+import (
+	"strings"
+	"testing"
+)
+
+func sequence(t *testing.T, strategy LoadBalancingStrategy, n int) string {
+	var selected []string
+	for i := 0; i < n; i++ {
+		ip, err := strategy.Select(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selected = append(selected, ip)
+	}
+	return strings.Join(selected, "")
+}
+
+func TestSmoothWRRSequence(t *testing.T) {
+	tests := []struct {
+		name    string
+		weights Weights
+		expect  string
+	}{
+		{"interleaved", Weights{Ips: []string{"a", "b", "c"}, Weights: []int{5, 1, 1}}, "aabacaa"},
+		{"equal weights", Weights{Ips: []string{"a", "b", "c"}, Weights: []int{1, 1, 1}}, "abc"},
+		{"two to one", Weights{Ips: []string{"a", "b"}, Weights: []int{2, 1}}, "aba"},
+		{"zero weight is skipped", Weights{Ips: []string{"a", "b", "c"}, Weights: []int{1, 0, 1}}, "ac"},
+		{"single server", Weights{Ips: []string{"a"}, Weights: []int{3}}, "aaa"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			strategy, err := NewSmoothWRRStrategy(test.weights, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the sequence repeats after the sum of the weights
+			expect := test.expect + test.expect
+			if s := sequence(t, strategy, len(expect)); s != expect {
+				t.Errorf("got %s, expected %s", s, expect)
+			}
+		})
+	}
+}
+
+func TestSmoothWRRContinuesOnUpdate(t *testing.T) {
+	weights := Weights{Ips: []string{"a", "b"}, Weights: []int{1, 1}}
+	first, _ := NewSmoothWRRStrategy(weights, nil)
+	if s := sequence(t, first, 1); s != "a" {
+		t.Fatalf("got %s, expected a", s)
+	}
+	second, _ := NewSmoothWRRStrategy(weights, first)
+	if s := sequence(t, second, 2); s != "ba" {
+		t.Errorf("got %s, expected the sequence to continue with ba", s)
+	}
+	restarted, _ := NewSmoothWRRStrategy(weights, nil)
+	if s := sequence(t, restarted, 2); s != "ab" {
+		t.Errorf("got %s, expected ab without previous strategy", s)
+	}
+}
+
+func TestSmoothWRRWithoutWeightedServers(t *testing.T) {
+	if _, err := NewSmoothWRRStrategy(Weights{Ips: []string{"a"}, Weights: []int{0}}, nil); err == nil {
+		t.Error("expected an error")
+	}
+}
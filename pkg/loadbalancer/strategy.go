@@ -1,5 +1,179 @@
 package loadbalancer
 
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Weights struct {
+	Ips     []string `json:"ips" yaml:"ips"`
+	Weights []int    `json:"weights" yaml:"weights"`
+	// Gateways optionally marks the servers that are load balancers of other zones
+	Gateways []bool `json:"gateways,omitempty" yaml:"gateways,omitempty"`
+	// Zones optionally holds the zone of every server
+	Zones []string `json:"zones,omitempty" yaml:"zones,omitempty"`
+	// Priorities optionally groups the servers into tiers, 0 is the highest priority
+	Priorities []int `json:"priorities,omitempty" yaml:"priorities,omitempty"`
+}
+
+// IsGateway returns whether the server at index i is marked as gateway
+func (weights Weights) IsGateway(i int) bool {
+	return i < len(weights.Gateways) && weights.Gateways[i]
+}
+
+// ZoneOf returns the zone of the server at index i, or an empty string if it is unknown
+func (weights Weights) ZoneOf(i int) string {
+	if i < len(weights.Zones) {
+		return weights.Zones[i]
+	}
+	return ""
+}
+
+// PriorityOf returns the priority of the server at index i, servers without priority have the highest priority 0
+func (weights Weights) PriorityOf(i int) int {
+	if i < len(weights.Priorities) {
+		return weights.Priorities[i]
+	}
+	return 0
+}
+
+// Filter returns the weights of the servers for which keep returns true
+func (weights Weights) Filter(keep func(ip string) bool) Weights {
+	filtered := Weights{
+		Ips:     []string{},
+		Weights: []int{},
+	}
+	for i, ip := range weights.Ips {
+		if keep(ip) {
+			filtered.Ips = append(filtered.Ips, ip)
+			filtered.Weights = append(filtered.Weights, weights.Weights[i])
+			if len(weights.Gateways) > 0 {
+				filtered.Gateways = append(filtered.Gateways, weights.IsGateway(i))
+			}
+			if len(weights.Zones) > 0 {
+				filtered.Zones = append(filtered.Zones, weights.ZoneOf(i))
+			}
+			if len(weights.Priorities) > 0 {
+				filtered.Priorities = append(filtered.Priorities, weights.PriorityOf(i))
+			}
+		}
+	}
+	return filtered
+}
+
+// Concat returns the servers of weights followed by the servers of other
+func (weights Weights) Concat(other Weights) Weights {
+	concatenated := Weights{
+		Ips:     append(append([]string{}, weights.Ips...), other.Ips...),
+		Weights: append(append([]int{}, weights.Weights...), other.Weights...),
+	}
+	if len(weights.Gateways) > 0 || len(other.Gateways) > 0 {
+		for _, w := range []Weights{weights, other} {
+			for i := range w.Ips {
+				concatenated.Gateways = append(concatenated.Gateways, w.IsGateway(i))
+			}
+		}
+	}
+	if len(weights.Zones) > 0 || len(other.Zones) > 0 {
+		for _, w := range []Weights{weights, other} {
+			for i := range w.Ips {
+				concatenated.Zones = append(concatenated.Zones, w.ZoneOf(i))
+			}
+		}
+	}
+	if len(weights.Priorities) > 0 || len(other.Priorities) > 0 {
+		for _, w := range []Weights{weights, other} {
+			for i := range w.Ips {
+				concatenated.Priorities = append(concatenated.Priorities, w.PriorityOf(i))
+			}
+		}
+	}
+	return concatenated
+}
+
+// Result describes the outcome of a request that was forwarded to a backend
+type Result struct {
+	StatusCode int
+	Duration   time.Duration
+	// Err is set if the request could not be proxied, e.g., because the backend refused the connection
+	Err error
+}
+
+// ErrSkipped is the Err of the Result of a backend that was selected but not used, e.g., because the request had already
+// been sent to it before
+var ErrSkipped = errors.New("selected backend was skipped")
+
+// LoadBalancingStrategy selects the backend of a single function. Implementations have to be safe for concurrent use.
 type LoadBalancingStrategy interface {
-	a()
+	// Select returns the ip of the backend that should serve the request
+	Select(req *http.Request) (string, error)
+
+	// Done is called with the outcome of every request that was forwarded to an ip returned by Select
+	Done(ip string, result Result)
+}
+
+// Inspector is implemented by strategies that expose their internal state, e.g., to debug the load balancing
+type Inspector interface {
+	// Inspect returns a snapshot of the state that can be encoded as JSON
+	Inspect() interface{}
+}
+
+// Factory creates a strategy from the weights of a function. On weight updates, the strategy that has been used so far
+// is passed as previous (otherwise nil), which allows implementations to carry over their state.
+type Factory func(weights Weights, previous LoadBalancingStrategy) (LoadBalancingStrategy, error)
+
+// Builder creates the Factory of a strategy, options of the strategy can be read from the given environment.
+type Builder func(environment env.Environment) (Factory, error)
+
+var (
+	registryMtx sync.RWMutex
+	registry    = make(map[string]Builder)
+)
+
+// Register makes a strategy available under the given (case-insensitive) name. Registering a name twice replaces the
+// previous strategy.
+func Register(name string, builder Builder) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+	registry[strings.ToLower(name)] = builder
+}
+
+func Lookup(name string) (Builder, bool) {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	builder, found := registry[strings.ToLower(name)]
+	return builder, found
+}
+
+// Names returns the names of all registered strategies in alphabetical order
+func Names() []string {
+	registryMtx.RLock()
+	defer registryMtx.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewFactory looks up the strategy with the given name and builds its Factory
+func NewFactory(name string, environment env.Environment) (Factory, error) {
+	builder, found := Lookup(name)
+	if !found {
+		return nil, fmt.Errorf("unknown load balancing strategy '%s', available: %s", name, strings.Join(Names(), ", "))
+	}
+	return builder(environment)
+}
+
+func staticBuilder(factory Factory) Builder {
+	return func(env.Environment) (Factory, error) {
+		return factory, nil
+	}
 }
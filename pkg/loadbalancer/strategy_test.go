@@ -0,0 +1,114 @@
+package loadbalancer
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// namedStrategy always selects its name and remembers the strategy it replaced
+type namedStrategy struct {
+	name     string
+	previous LoadBalancingStrategy
+}
+
+func (strategy *namedStrategy) Select(*http.Request) (string, error) {
+	return strategy.name, nil
+}
+
+func (strategy *namedStrategy) Done(string, Result) {}
+
+func namedBuilder(name string) Builder {
+	return staticBuilder(func(weights Weights, previous LoadBalancingStrategy) (LoadBalancingStrategy, error) {
+		return &namedStrategy{name: name, previous: previous}, nil
+	})
+}
+
+// register registers the builder for the duration of the test
+func register(t *testing.T, name string, builder Builder) {
+	Register(name, builder)
+	t.Cleanup(func() {
+		registryMtx.Lock()
+		defer registryMtx.Unlock()
+		delete(registry, strings.ToLower(name))
+	})
+}
+
+func selectOf(t *testing.T, factory Factory) string {
+	strategy, err := factory(Weights{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, _ := strategy.Select(nil)
+	return ip
+}
+
+func TestRegistry(t *testing.T) {
+	for _, name := range []string{"hash", "least", "lvs-wrr", "p2c", "wrr"} {
+		if _, found := Lookup(name); !found {
+			t.Errorf("%s is not registered", name)
+		}
+	}
+
+	register(t, "Test-Strategy", namedBuilder("first"))
+	builder, found := Lookup("test-strategy")
+	if !found {
+		t.Fatal("names are case-insensitive, test-strategy has not been found")
+	}
+	factory, _ := builder(env.MapEnvironment{})
+	if ip := selectOf(t, factory); ip != "first" {
+		t.Errorf("selected %s, expected the first strategy", ip)
+	}
+	if names := strings.Join(Names(), ","); !strings.Contains(names, "test-strategy") {
+		t.Errorf("names are %s, expected test-strategy", names)
+	}
+
+	// a duplicate name replaces the previous strategy
+	register(t, "TEST-STRATEGY", namedBuilder("second"))
+	factory, err := NewFactory("test-strategy", env.MapEnvironment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := selectOf(t, factory); ip != "second" {
+		t.Errorf("selected %s, expected the second strategy", ip)
+	}
+	if count := strings.Count(strings.Join(Names(), ","), "test-strategy"); count != 1 {
+		t.Errorf("test-strategy is listed %d times", count)
+	}
+}
+
+func TestNewFactoryErrors(t *testing.T) {
+	_, err := NewFactory("unknown", env.MapEnvironment{})
+	if err == nil || !strings.Contains(err.Error(), "unknown load balancing strategy 'unknown'") || !strings.Contains(err.Error(), "wrr") {
+		t.Errorf("got error %v, expected the unknown name and the available strategies", err)
+	}
+	if _, found := Lookup("unknown"); found {
+		t.Error("found an unknown strategy")
+	}
+
+	invalid := errors.New("invalid option")
+	register(t, "invalid", func(env.Environment) (Factory, error) {
+		return nil, invalid
+	})
+	if _, err := NewFactory("invalid", env.MapEnvironment{}); !errors.Is(err, invalid) {
+		t.Errorf("got error %v, expected the error of the builder", err)
+	}
+}
+
+func TestFactoryReceivesPreviousStrategy(t *testing.T) {
+	register(t, "test-previous", namedBuilder("named"))
+	factory, err := NewFactory("test-previous", env.MapEnvironment{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, _ := factory(Weights{}, nil)
+	if previous := first.(*namedStrategy).previous; previous != nil {
+		t.Errorf("the first strategy got %v as previous", previous)
+	}
+	second, _ := factory(Weights{}, first)
+	if previous := second.(*namedStrategy).previous; previous != first {
+		t.Errorf("the second strategy got %v as previous, expected the first one", previous)
+	}
+}
@@ -1,8 +1,9 @@
-package handler
+package loadbalancer
 
 import (
 	"errors"
 	"math"
+	"net/http"
 	"sync"
 )
 
@@ -96,7 +97,7 @@ func gcd(ns []int) (int, error) {
 }
 
 func min(ns []int) (int, error) {
-	if ns == nil {
+	if len(ns) == 0 {
 		return -1, errors.New("cannot calculate min of nil or empty slice")
 	}
 	min := math.MaxInt
@@ -109,7 +110,7 @@ func min(ns []int) (int, error) {
 }
 
 func max(ns []int) (int, error) {
-	if ns == nil {
+	if len(ns) == 0 {
 		return -1, errors.New("cannot calculate max of nil or empty slice")
 	}
 	max := 0
@@ -138,3 +139,48 @@ func (w *WRR) Next() string {
 	}
 	panic("reached a theoretically unreachable state trying to calculate the next server in WRR.Next() method")
 }
+
+func (w *WRR) Select(*http.Request) (string, error) {
+	return w.Next(), nil
+}
+
+func (w *WRR) Done(string, Result) {
+}
+
+// WRRState is the state of a WRR, Last is the index of the server that has been selected last and CW the current weight
+type WRRState struct {
+	Servers []string `json:"servers"`
+	Weights []int    `json:"weights"`
+	Last    int      `json:"last"`
+	CW      int      `json:"cw"`
+	Max     int      `json:"max"`
+	GCD     int      `json:"gcd"`
+}
+
+func (w *WRR) Inspect() interface{} {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	return WRRState{
+		Servers: append([]string(nil), w.servers...),
+		Weights: append([]int(nil), w.weights...),
+		Last:    w.Last,
+		CW:      w.cw,
+		Max:     w.max,
+		GCD:     w.gcd,
+	}
+}
+
+// NewWRRStrategy is the Factory of the weighted round-robin strategy, it continues at the position of a previous WRR
+func NewWRRStrategy(weights Weights, previous LoadBalancingStrategy) (LoadBalancingStrategy, error) {
+	if wrr, ok := previous.(*WRR); ok {
+		wrr.mtx.Lock()
+		last := wrr.Last
+		wrr.mtx.Unlock()
+		return NewWRRWithLast(weights, last)
+	}
+	return NewWRR(weights)
+}
+
+func init() {
+	Register("lvs-wrr", staticBuilder(NewWRRStrategy))
+}
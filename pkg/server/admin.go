@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"net"
+	"net/http"
+)
+
+// AdminServer serves endpoints for operators, e.g., metrics, on a port that is separate from the function calls
+type AdminServer struct {
+	mux        *http.ServeMux
+	httpServer *http.Server
+}
+
+func NewAdminServer() *AdminServer {
+	return &AdminServer{
+		mux: http.NewServeMux(),
+	}
+}
+
+// Handle registers the handler for the pattern, see http.ServeMux
+func (server *AdminServer) Handle(pattern string, handler http.Handler) {
+	server.mux.Handle(pattern, handler)
+}
+
+// Listen serves on addr in the background
+func (server *AdminServer) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	server.httpServer = &http.Server{
+		Handler: server.mux,
+	}
+	go func() {
+		if err := server.httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			zap.S().Errorf("error serving admin endpoints on %s: %s", addr, err)
+		}
+	}()
+	return nil
+}
+
+func (server *AdminServer) Shutdown(ctx context.Context) error {
+	if server.httpServer == nil {
+		return nil
+	}
+	return server.httpServer.Shutdown(ctx)
+}
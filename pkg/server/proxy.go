@@ -1,45 +1,128 @@
 package server
 
 import (
+	"context"
 	"edgebench/go-load-balancer/pkg/handler"
+	"go.uber.org/zap"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
-	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // Boilerplate code taken from: https://hackernoon.com/writing-a-reverse-proxy-in-just-one-line-with-go-c1edfa78c84b
 
+// shutdownTimeout bounds the time requests that are still served on a previous address have to finish
+const shutdownTimeout = 30 * time.Second
+
+// ReadinessPath answers 200 while the server accepts new requests and 503 once it drains
+const ReadinessPath = "/ready"
+
+type handlerRef struct {
+	handler.Handler
+}
+
+// ReverseProxyServer serves function calls with a Handler that can be swapped at runtime. Requests that are in flight
+// while the handler is swapped finish on the previous handler.
 type ReverseProxyServer struct {
-	handler handler.Handler
+	// Addr is the address to listen on, defaults to the port of eb_go_lb_listen_port
+	Addr       string
+	handler    atomic.Pointer[handlerRef]
+	mtx        sync.Mutex
+	httpServer *http.Server
+	ready      atomic.Bool
 }
 
 func NewReverseProxyServer(handler handler.Handler) *ReverseProxyServer {
-	return &ReverseProxyServer{
-		handler: handler,
+	server := &ReverseProxyServer{}
+	server.SetHandler(handler)
+	return server
+}
+
+func (server *ReverseProxyServer) Handler() handler.Handler {
+	return server.handler.Load().Handler
+}
+
+// SetHandler swaps the handler and returns the previous one
+func (server *ReverseProxyServer) SetHandler(h handler.Handler) handler.Handler {
+	previous := server.handler.Swap(&handlerRef{h})
+	if previous == nil {
+		return nil
+	}
+	return previous.Handler
+}
+
+// SetReady changes the response of ReadinessPath, e.g., to let Kubernetes stop sending requests before shutting down
+func (server *ReverseProxyServer) SetReady(ready bool) {
+	server.ready.Store(ready)
+}
+
+func (server *ReverseProxyServer) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == ReadinessPath {
+		server.serveReadiness(res)
+		return
 	}
+	server.Handler().Handle(res, req)
 }
 
-// Get env var or default
-func getEnv(key, fallback string) string {
-	if value, ok := os.LookupEnv(key); ok {
-		return value
+func (server *ReverseProxyServer) serveReadiness(res http.ResponseWriter) {
+	if !server.ready.Load() {
+		http.Error(res, "draining", http.StatusServiceUnavailable)
+		return
 	}
-	return fallback
+	res.WriteHeader(http.StatusOK)
 }
 
-// Get the port to listen on
-func getListenAddress() string {
-	port := getEnv("eb_go_lb_listen_port", "8079")
-	return ":" + port
+// Listen serves on addr in the background. If the server already listens on another address, the previous listener is
+// closed and its connections are shut down gracefully.
+func (server *ReverseProxyServer) Listen(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	httpServer := &http.Server{
+		Handler: server,
+	}
+	go func() {
+		if err := httpServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			zap.S().Errorf("error serving on %s: %s", addr, err)
+		}
+	}()
+
+	server.mtx.Lock()
+	previous, previousAddr := server.httpServer, server.Addr
+	server.httpServer = httpServer
+	server.Addr = addr
+	server.mtx.Unlock()
+	server.SetReady(true)
+
+	if previous != nil {
+		zap.S().Infof("moved from %s to %s", previousAddr, addr)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			if err := previous.Shutdown(ctx); err != nil {
+				zap.S().Errorf("error shutting down previous listener: %s", err)
+			}
+		}()
+	}
+	return nil
 }
 
-func (server *ReverseProxyServer) Run() {
-	// start server
-	http.HandleFunc("/", server.handler.Handle)
-	if err := http.ListenAndServe(getListenAddress(), nil); err != nil {
-		panic(err)
+// Shutdown stops accepting connections and waits until the requests in flight have finished or ctx is done. Previous
+// listeners that are still shutting down are not waited for.
+func (server *ReverseProxyServer) Shutdown(ctx context.Context) error {
+	server.SetReady(false)
+	server.mtx.Lock()
+	httpServer := server.httpServer
+	server.mtx.Unlock()
+	if httpServer == nil {
+		return nil
 	}
+	return httpServer.Shutdown(ctx)
 }
 
 // Serve a reverse proxy for a given url
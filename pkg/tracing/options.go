@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"edgebench/go-load-balancer/pkg/env"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+type Options struct {
+	Enabled bool `yaml:"enabled"`
+	// Endpoint is the url of the OTLP/HTTP traces endpoint of the collector
+	Endpoint    string `yaml:"endpoint"`
+	ServiceName string `yaml:"service_name"`
+	// SampleRatio is the share of new traces that are recorded, incoming traces keep the decision of the caller
+	SampleRatio   float64       `yaml:"sample_ratio"`
+	BatchInterval time.Duration `yaml:"batch_interval"`
+}
+
+func NewDefaultOptions() Options {
+	return Options{
+		Enabled:       false,
+		Endpoint:      "http://localhost:4318/v1/traces",
+		ServiceName:   "go-load-balancer",
+		SampleRatio:   1,
+		BatchInterval: 5 * time.Second,
+	}
+}
+
+// ReadOptions overrides the options with the eb_go_lb_tracing* variables of the environment
+func ReadOptions(environment env.Environment, options Options) (Options, error) {
+	if enabled, found, err := environment.LookupBool("eb_go_lb_tracing"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_tracing: %s", err)
+		}
+		options.Enabled = enabled
+	}
+	if endpoint, found := environment.Lookup("eb_go_lb_tracing_endpoint"); found {
+		options.Endpoint = endpoint
+	}
+	if serviceName, found := environment.Lookup("eb_go_lb_tracing_service_name"); found {
+		options.ServiceName = serviceName
+	}
+	if ratio, found, err := environment.LookupFloat("eb_go_lb_tracing_sample_ratio"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_tracing_sample_ratio: %s", err)
+		}
+		options.SampleRatio = ratio
+	}
+	if interval, found, err := environment.LookupDuration("eb_go_lb_tracing_batch_interval"); found {
+		if err != nil {
+			return options, fmt.Errorf("eb_go_lb_tracing_batch_interval: %s", err)
+		}
+		options.BatchInterval = interval
+	}
+	return options, nil
+}
+
+func (options Options) Validate() error {
+	if endpoint, err := url.Parse(options.Endpoint); err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("tracing endpoint must be an http or https url, got '%s'", options.Endpoint)
+	}
+	if options.ServiceName == "" {
+		return fmt.Errorf("tracing service name must not be empty")
+	}
+	if options.SampleRatio < 0 || options.SampleRatio > 1 {
+		return fmt.Errorf("tracing sample ratio must be between 0 and 1")
+	}
+	if options.BatchInterval <= 0 {
+		return fmt.Errorf("tracing batch interval must be positive")
+	}
+	return nil
+}
+
+// NewTracerWithOptions returns the tracer and its exporter, which has to be closed to send the remaining spans. If
+// tracing is disabled, both are nil.
+func NewTracerWithOptions(options Options) (*Tracer, *OTLPExporter) {
+	if !options.Enabled {
+		return nil, nil
+	}
+	exporter := NewOTLPExporter(options.Endpoint, options.ServiceName, options.BatchInterval)
+	return NewTracer(exporter, options.SampleRatio), exporter
+}
@@ -0,0 +1,255 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxQueuedSpans = 2048
+	maxBatchSize   = 512
+)
+
+// OTLPExporter sends spans in batches to an OpenTelemetry collector with OTLP/HTTP in the JSON encoding. If the
+// collector is slow or unavailable, spans that do not fit into the queue are dropped.
+type OTLPExporter struct {
+	Endpoint    string
+	ServiceName string
+	Interval    time.Duration
+	client      *http.Client
+
+	queue chan *Span
+	stop  chan struct{}
+	done  chan struct{}
+
+	droppedMtx sync.Mutex
+	dropped    int
+}
+
+func NewOTLPExporter(endpoint string, serviceName string, interval time.Duration) *OTLPExporter {
+	exporter := &OTLPExporter{
+		Endpoint:    endpoint,
+		ServiceName: serviceName,
+		Interval:    interval,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		queue:       make(chan *Span, maxQueuedSpans),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+	go exporter.run()
+	return exporter
+}
+
+func (exporter *OTLPExporter) Export(span *Span) {
+	select {
+	case exporter.queue <- span:
+	default:
+		exporter.droppedMtx.Lock()
+		exporter.dropped++
+		exporter.droppedMtx.Unlock()
+	}
+}
+
+// Close sends the queued spans and stops the exporter
+func (exporter *OTLPExporter) Close() error {
+	close(exporter.stop)
+	<-exporter.done
+	return nil
+}
+
+func (exporter *OTLPExporter) run() {
+	defer close(exporter.done)
+	ticker := time.NewTicker(exporter.Interval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, maxBatchSize)
+	for {
+		select {
+		case span := <-exporter.queue:
+			batch = append(batch, span)
+			if len(batch) < maxBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-exporter.stop:
+			exporter.send(exporter.drain(batch))
+			return
+		}
+		exporter.send(batch)
+		batch = batch[:0]
+	}
+}
+
+// drain appends the spans that are currently queued to batch
+func (exporter *OTLPExporter) drain(batch []*Span) []*Span {
+	for {
+		select {
+		case span := <-exporter.queue:
+			batch = append(batch, span)
+		default:
+			return batch
+		}
+	}
+}
+
+func (exporter *OTLPExporter) send(spans []*Span) {
+	exporter.droppedMtx.Lock()
+	dropped := exporter.dropped
+	exporter.dropped = 0
+	exporter.droppedMtx.Unlock()
+	if dropped > 0 {
+		zap.S().Warnf("dropped %d spans, the trace queue was full", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(exporter.request(spans))
+	if err != nil {
+		zap.S().Errorf("error encoding spans: %s", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), exporter.client.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, exporter.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		zap.S().Errorf("error exporting spans: %s", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := exporter.client.Do(req)
+	if err != nil {
+		zap.S().Errorf("error exporting %d spans: %s", len(spans), err)
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		zap.S().Errorf("error exporting %d spans: collector responded with %s", len(spans), resp.Status)
+	}
+}
+
+// The following types are the JSON encoding of the OTLP ExportTraceServiceRequest, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/trace/v1/trace.proto
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// status codes of OTLP
+const (
+	statusUnset = 0
+	statusError = 2
+)
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+	// IntValue is a string, because the JSON encoding of OTLP represents 64 bit integers as strings
+	IntValue *string `json:"intValue,omitempty"`
+}
+
+func newOtlpAttribute(attribute Attribute) otlpAttribute {
+	var value otlpValue
+	switch v := attribute.Value.(type) {
+	case string:
+		value.StringValue = &v
+	case bool:
+		value.BoolValue = &v
+	case int:
+		s := strconv.Itoa(v)
+		value.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		value.IntValue = &s
+	default:
+		s := fmt.Sprint(v)
+		value.StringValue = &s
+	}
+	return otlpAttribute{Key: attribute.Key, Value: value}
+}
+
+func (exporter *OTLPExporter) request(spans []*Span) otlpRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, span := range spans {
+		span.mtx.Lock()
+		s := otlpSpan{
+			TraceID:           span.context.TraceID.String(),
+			SpanID:            span.context.SpanID.String(),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: statusUnset},
+		}
+		if span.parent.IsValid() {
+			s.ParentSpanID = span.parent.String()
+		}
+		for _, attribute := range span.attributes {
+			s.Attributes = append(s.Attributes, newOtlpAttribute(attribute))
+		}
+		if span.err != "" {
+			s.Status = otlpStatus{Code: statusError, Message: span.err}
+		}
+		span.mtx.Unlock()
+		encoded = append(encoded, s)
+	}
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{newOtlpAttribute(Attribute{"service.name", exporter.ServiceName})},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "go-load-balancer"},
+				Spans: encoded,
+			}},
+		}},
+	}
+}
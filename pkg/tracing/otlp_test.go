@@ -0,0 +1,140 @@
+package tracing
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestCollector starts a collector that passes the decoded requests to requests
+func newTestCollector(t *testing.T, requests chan<- otlpRequest) string {
+	server := httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s with content type %s", req.Method, req.Header.Get("Content-Type"))
+		}
+		var request otlpRequest
+		if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+			t.Errorf("error decoding spans: %s", err)
+		}
+		requests <- request
+	}))
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func exportedSpans(request otlpRequest) []otlpSpan {
+	var spans []otlpSpan
+	for _, resourceSpans := range request.ResourceSpans {
+		for _, scopeSpans := range resourceSpans.ScopeSpans {
+			spans = append(spans, scopeSpans.Spans...)
+		}
+	}
+	return spans
+}
+
+func attribute(attributes []otlpAttribute, key string) *otlpValue {
+	for _, a := range attributes {
+		if a.Key == key {
+			return &a.Value
+		}
+	}
+	return nil
+}
+
+func TestOTLPExporterPayload(t *testing.T) {
+	requests := make(chan otlpRequest, 1)
+	exporter := NewOTLPExporter(newTestCollector(t, requests), "golb-test", time.Hour)
+	tracer := NewTracer(exporter, 1)
+
+	req := httptest.NewRequest(http.MethodGet, "/function/f/", nil)
+	req.Header.Set(TraceparentHeader, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	server := tracer.StartServer(req, "golb f")
+	server.SetAttribute("golb.function", "f")
+	server.SetAttribute("golb.gateway_hop", false)
+	client := server.StartChild("golb f forward", Client)
+	client.SetAttribute("golb.attempt", 1)
+	client.SetError(errors.New("connection refused"))
+	client.End()
+	server.End()
+	// the interval does not elapse, close sends the queued spans
+	exporter.Close()
+
+	request := <-requests
+	if len(request.ResourceSpans) != 1 || len(request.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("expected one resource and scope, got %+v", request)
+	}
+	service := attribute(request.ResourceSpans[0].Resource.Attributes, "service.name")
+	if service == nil || service.StringValue == nil || *service.StringValue != "golb-test" {
+		t.Errorf("unexpected service name %+v", service)
+	}
+	if scope := request.ResourceSpans[0].ScopeSpans[0].Scope.Name; scope != "go-load-balancer" {
+		t.Errorf("unexpected scope %s", scope)
+	}
+	spans := exportedSpans(request)
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, expected 2", len(spans))
+	}
+	clientSpan, serverSpan := spans[0], spans[1]
+
+	tests := []struct {
+		name     string
+		got      interface{}
+		expected interface{}
+	}{
+		{"server trace", serverSpan.TraceID, "0af7651916cd43dd8448eb211c80319c"},
+		{"server parent", serverSpan.ParentSpanID, "b7ad6b7169203331"},
+		{"server kind", serverSpan.Kind, Server},
+		{"server status", serverSpan.Status.Code, statusUnset},
+		{"client trace", clientSpan.TraceID, serverSpan.TraceID},
+		{"client parent", clientSpan.ParentSpanID, serverSpan.SpanID},
+		{"client kind", clientSpan.Kind, Client},
+		{"client name", clientSpan.Name, "golb f forward"},
+		{"client status", clientSpan.Status, otlpStatus{Code: statusError, Message: "connection refused"}},
+	}
+	for _, test := range tests {
+		if test.got != test.expected {
+			t.Errorf("%s is %v, expected %v", test.name, test.got, test.expected)
+		}
+	}
+	if value := attribute(serverSpan.Attributes, "golb.gateway_hop"); value == nil || value.BoolValue == nil || *value.BoolValue {
+		t.Errorf("unexpected bool attribute %+v", value)
+	}
+	if value := attribute(clientSpan.Attributes, "golb.attempt"); value == nil || value.IntValue == nil || *value.IntValue != "1" {
+		t.Errorf("unexpected int attribute %+v", value)
+	}
+	if serverSpan.StartTimeUnixNano == "" || serverSpan.EndTimeUnixNano < serverSpan.StartTimeUnixNano {
+		t.Errorf("unexpected times %s to %s", serverSpan.StartTimeUnixNano, serverSpan.EndTimeUnixNano)
+	}
+}
+
+func TestOTLPExporterBatchesByInterval(t *testing.T) {
+	requests := make(chan otlpRequest, 2)
+	interval := 200 * time.Millisecond
+	exporter := NewOTLPExporter(newTestCollector(t, requests), "golb-test", interval)
+	start := time.Now()
+	tracer := NewTracer(exporter, 1)
+	req := httptest.NewRequest(http.MethodGet, "/function/f/", nil)
+	for i := 0; i < 3; i++ {
+		tracer.StartServer(req, "golb f").End()
+	}
+	// spans that are not sampled are not exported
+	NewTracer(exporter, 0).StartServer(req, "golb f").End()
+
+	request := <-requests
+	if elapsed := time.Since(start); elapsed < interval {
+		t.Errorf("spans have been sent after %s, before the interval", elapsed)
+	}
+	if spans := exportedSpans(request); len(spans) != 3 {
+		t.Errorf("sent %d spans in the batch, expected 3", len(spans))
+	}
+	// nothing is sent for an empty batch
+	exporter.Close()
+	select {
+	case request := <-requests:
+		t.Errorf("unexpected request with %d spans", len(exportedSpans(request)))
+	default:
+	}
+}
@@ -0,0 +1,157 @@
+package tracing
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type SpanKind int
+
+// Span kinds as defined by OTLP
+const (
+	Server SpanKind = 2
+	Client SpanKind = 3
+)
+
+// Attribute is a key value pair of a span, the value is a string, bool, int or int64
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+// Span is an operation of a trace. Spans that are not sampled are propagated but not exported. All methods can be
+// called on a nil *Span, which records nothing.
+type Span struct {
+	tracer  *Tracer
+	context SpanContext
+	parent  SpanID
+	name    string
+	kind    SpanKind
+	start   time.Time
+
+	mtx        sync.Mutex
+	end        time.Time
+	attributes []Attribute
+	err        string
+	ended      bool
+}
+
+// Exporter sends ended spans to a tracing backend
+type Exporter interface {
+	Export(span *Span)
+}
+
+// Tracer creates spans and passes them to the exporter when they end. All methods can be called on a nil *Tracer,
+// which disables tracing.
+type Tracer struct {
+	exporter    Exporter
+	sampleRatio float64
+}
+
+func NewTracer(exporter Exporter, sampleRatio float64) *Tracer {
+	return &Tracer{
+		exporter:    exporter,
+		sampleRatio: sampleRatio,
+	}
+}
+
+// StartServer starts a span for an incoming request. If the request carries a valid traceparent header, the span
+// continues that trace and keeps its sampling decision, otherwise a new trace is sampled with the sample ratio.
+func (tracer *Tracer) StartServer(req *http.Request, name string) *Span {
+	if tracer == nil {
+		return nil
+	}
+	span := &Span{
+		tracer: tracer,
+		name:   name,
+		kind:   Server,
+		start:  time.Now(),
+	}
+	if parent, err := ParseTraceparent(req.Header.Get(TraceparentHeader)); err == nil {
+		span.context = SpanContext{TraceID: parent.TraceID, Sampled: parent.Sampled}
+		span.parent = parent.SpanID
+	} else {
+		span.context = SpanContext{TraceID: newTraceID(), Sampled: rand.Float64() < tracer.sampleRatio}
+	}
+	span.context.SpanID = newSpanID()
+	return span
+}
+
+// StartChild starts a span of the same trace with span as parent
+func (span *Span) StartChild(name string, kind SpanKind) *Span {
+	if span == nil {
+		return nil
+	}
+	return &Span{
+		tracer: span.tracer,
+		context: SpanContext{
+			TraceID: span.context.TraceID,
+			SpanID:  newSpanID(),
+			Sampled: span.context.Sampled,
+		},
+		parent: span.context.SpanID,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+}
+
+func (span *Span) Context() SpanContext {
+	if span == nil {
+		return SpanContext{}
+	}
+	return span.context
+}
+
+// Inject sets the traceparent header of the outgoing request, so that the receiver continues the trace
+func (span *Span) Inject(header http.Header) {
+	if span == nil {
+		return
+	}
+	header.Set(TraceparentHeader, span.context.Traceparent())
+}
+
+func (span *Span) SetAttribute(key string, value interface{}) {
+	if span == nil {
+		return
+	}
+	span.mtx.Lock()
+	defer span.mtx.Unlock()
+	for i := range span.attributes {
+		if span.attributes[i].Key == key {
+			span.attributes[i].Value = value
+			return
+		}
+	}
+	span.attributes = append(span.attributes, Attribute{key, value})
+}
+
+// SetError marks the span as failed
+func (span *Span) SetError(err error) {
+	if span == nil || err == nil {
+		return
+	}
+	span.mtx.Lock()
+	defer span.mtx.Unlock()
+	span.err = err.Error()
+}
+
+// End completes the span and exports it if it is sampled. Further calls are ignored.
+func (span *Span) End() {
+	if span == nil {
+		return
+	}
+	span.mtx.Lock()
+	if span.ended {
+		span.mtx.Unlock()
+		return
+	}
+	span.ended = true
+	span.end = time.Now()
+	span.mtx.Unlock()
+	if span.context.Sampled && span.tracer.exporter != nil {
+		span.tracer.exporter.Export(span)
+	}
+}
@@ -1,7 +1,6 @@
 package util
 
 import (
-	"edgebench/go-load-balancer/pkg/env"
 	"fmt"
 	"go.uber.org/zap"
 	"log"
@@ -30,14 +29,9 @@ func createProdLogger() (*zap.Logger, error) {
 	return config.Build()
 }
 
-func InitZapLogger() *zap.SugaredLogger {
-	mode, ok := env.OsEnv.Lookup("eb_go_lb_mode")
+// InitZapLoggerWithMode initializes the global logger for the mode, which is either prod or dev
+func InitZapLoggerWithMode(mode string) *zap.SugaredLogger {
 	text := ""
-	if !ok {
-		mode = "dev"
-		text = "no eb_go_lb_mode set, default to dev"
-	}
-
 	var plainlogger *zap.Logger
 	var logger *zap.SugaredLogger
 	var err error